@@ -4,12 +4,12 @@ import (
 	"context"
 	"errors"
 	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"io"
-	"log"
 	"net"
+	"net/http"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,31 +29,77 @@ func (e MsgType) String() string {
 	return etMsg[e]
 }
 
+// WsMessageType websocket 消息类型
+type WsMessageType int
+
+const (
+	TextMessage   WsMessageType = websocket.TextMessage
+	BinaryMessage WsMessageType = websocket.BinaryMessage
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrNoEndpoint   = errors.New("no endpoint")
+)
+
+var closedCtx = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// packet 读取到的数据, buf 不为空时处理完归还缓冲池
+type packet struct {
+	data []byte
+	cn   *connection
+}
+
+// Client socket 客户端, 所有公开方法可并发调用
 type Client struct {
 	ctx                 context.Context
 	cancel              context.CancelFunc
 	host                string
 	retryInterval       time.Duration
 	connectTimeout      time.Duration
-	conn                net.Conn
-	wsConn              *websocket.Conn
-	wsLock              sync.Mutex
+	mu                  sync.RWMutex
+	current             *connection
 	connectIndex        int
+	handshakeHandler    []func(index int)
 	connectedHandler    []func(index int)
 	disconnectIndex     int
 	disconnectedHandler []func(index int)
 	messageHandler      func(pkg []byte)
-	pkgChan             chan []byte
-	pkgWatcher          func(mtp MsgType, msg string, pkg []byte)
-	logWatcher          func(level zapcore.Level, msg string)
-	Tmp                 []byte
-	keepAlive           time.Duration
-	network             string
-	heartbeatCancel     context.CancelFunc
-	heartbeatPaused     bool
+	pkgChan             chan *packet
+	readBufferSize      int
+	callbacks           atomic.Int32
+	logger              *Log
+	// Tmp 未拆完的粘包数据, 只在 Message 回调中读写, 连接切换后清空
+	Tmp              []byte
+	tmpConn          *connection
+	keepAlive        time.Duration
+	network          string
+	heartbeatCancel  context.CancelFunc
+	heartbeatPaused  atomic.Bool
+	heartbeatTimeout time.Duration
+	lastReceive      atomic.Int64
+	heartbeatSent    atomic.Int64
+	endpoints        *endpoints
+	srv              *srv
+	state            *stateMachine
+	wsDialer         websocket.Dialer
+	wsHeader         http.Header
+	wsReadLimit      int64
+	wsCompression    bool
+	wsMessageType    atomic.Int32
+	metrics          *clientMetrics
+	wg               sync.WaitGroup
+	started          bool
+	stopped          bool
+	stopOnce         sync.Once
+	done             chan struct{}
 }
 
-// New a socket client, network: tcp tcp4 tcp6 udp udp4 udp6 ...
+// New a socket client, network: tcp tcp4 tcp6 udp udp4 udp6 ws wss, host 可为空由 Endpoints 或 SRV 选项提供
 func New(ctx context.Context, network string, host string, options ...Option) *Client {
 	ctx1, cancel := context.WithCancel(ctx)
 	if network == "" {
@@ -66,80 +112,176 @@ func New(ctx context.Context, network string, host string, options ...Option) *C
 		host:           host,
 		retryInterval:  time.Second * 3,
 		connectTimeout: time.Second * 10,
-		pkgChan:        make(chan []byte, 10),
-		messageHandler: func(pkg []byte) {},
-		pkgWatcher: func(mtp MsgType, msg string, pkg []byte) {
-			log.Println(mtp.String(), len(pkg), "types pkg:", pkg)
-		},
-		logWatcher: func(level zapcore.Level, msg string) {
-			log.Println(msg)
+		wsDialer: websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: time.Second * 45,
 		},
+		wsHeader:       make(http.Header),
+		state:          newStateMachine(),
+		done:           make(chan struct{}),
+		endpoints:      newEndpoints(host),
+		pkgChan:        make(chan *packet, 10),
+		metrics:        newClientMetrics(nil),
+		readBufferSize: 1024,
+		messageHandler: func(pkg []byte) {},
+		logger:         NewLog(),
 	}
+	c.wsMessageType.Store(int32(TextMessage))
 	c.With(options...)
 	return c
 }
 
+// With 应用选项, 应在 Start 之前调用
 func (c *Client) With(options ...Option) {
 	for _, o := range options {
 		o(c)
 	}
 }
 
+// Host 当前连接的节点, 未连接时返回初始节点
 func (c *Client) Host() string {
+	if cn := c.connection(); cn != nil {
+		return cn.host
+	}
+	if c.host == "" {
+		if list := c.endpoints.snapshot(); len(list) > 0 {
+			return list[0].Host
+		}
+	}
 	return c.host
 }
 
+// Subprotocol 返回 websocket 握手协商的子协议
+func (c *Client) Subprotocol() string {
+	if cn := c.connection(); cn != nil {
+		return cn.subprotocol()
+	}
+	return ""
+}
+
+// SetWsMessageType 设置 websocket 发送的消息类型, 可在运行中切换
+func (c *Client) SetWsMessageType(mt WsMessageType) {
+	if mt == TextMessage || mt == BinaryMessage {
+		c.wsMessageType.Store(int32(mt))
+	}
+}
+
 func (c *Client) Start() {
-	c.startListen()
+	c.mu.Lock()
+	if c.started || c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	c.started = true
+	c.mu.Unlock()
 	c.dispatch()
+	c.discover()
 	c.tryConnect()
-	c.logWatcher(zapcore.InfoLevel, "client start")
+	c.logger.Print(zapcore.InfoLevel, "client start", c.fields(nil)...)
 }
 
+// Stop 停止客户端并等待所有内部协程退出, 可重复调用.
+// Message、Connect 等回调执行期间调用时只发出停止信号不等待, 可通过 Done 等待内部协程退出
 func (c *Client) Stop() {
-	c.logWatcher(zapcore.InfoLevel, "client stop")
-	c.reset()
-	c.cancel()
-	close(c.pkgChan)
+	c.stopOnce.Do(func() {
+		c.logger.Print(zapcore.InfoLevel, "client stop", c.fields(c.connection())...)
+		c.state.set(Draining, ErrStopped, c.index(false))
+		c.mu.Lock()
+		c.stopped = true
+		c.mu.Unlock()
+		c.cancel()
+		c.reset(nil, ErrStopped)
+		go func() {
+			c.wg.Wait()
+			c.state.set(Stopped, ErrStopped, c.index(false))
+			close(c.done)
+		}()
+	})
+	if c.callbacks.Load() == 0 {
+		<-c.done
+	}
+}
+
+// Done 停止后所有内部协程退出时关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
 }
 
 func (c *Client) Send(pkg []byte) (err error) {
-	if c.conn == nil && c.wsConn == nil {
-		return errors.New("client error: not connected")
+	if c.ctx.Err() != nil {
+		return c.transportError(OpWrite, nil, ErrStopped)
 	}
-	if c.conn != nil {
-		_, err = c.conn.Write(pkg)
-	} else {
-		c.wsLock.Lock()
-		defer c.wsLock.Unlock()
-		err = c.wsConn.WriteMessage(websocket.TextMessage, pkg)
+	cn := c.connection()
+	if cn == nil {
+		return c.transportError(OpWrite, nil, ErrNotConnected)
 	}
+	if err = cn.write(WsMessageType(c.wsMessageType.Load()), pkg); err != nil {
+		return c.transportError(OpWrite, cn, err)
+	}
+	c.metrics.sent(cn.host, len(pkg))
+	c.logger.Package(Send, "raw package", pkg, c.fields(cn)...)
+
+	return nil
+}
+
+func (c *Client) connection() *connection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current
+}
+
+// QueueDepth 已接收等待处理的包数量
+func (c *Client) QueueDepth() int {
+	return len(c.pkgChan)
+}
 
-	if err == nil {
-		c.pkgWatcher(Send, "raw package", pkg)
+// ConnContext 当前连接的 context 和连接序号, 连接断开或客户端停止时取消, 未连接时返回已取消的 context
+func (c *Client) ConnContext() (context.Context, int) {
+	if cn := c.connection(); cn != nil {
+		return cn.ctx, cn.index
 	}
+	return closedCtx, 0
+}
 
-	return err
+func (c *Client) index(connect bool) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if connect {
+		return c.connectIndex
+	}
+	return c.disconnectIndex
 }
 
 func (c *Client) listenConnect(h func(index int)) {
 	if h != nil {
+		c.mu.Lock()
 		c.connectedHandler = append(c.connectedHandler, h)
+		c.mu.Unlock()
+	}
+}
+
+func (c *Client) listenHandshake(h func(index int)) {
+	if h != nil {
+		c.mu.Lock()
+		c.handshakeHandler = append(c.handshakeHandler, h)
+		c.mu.Unlock()
 	}
 }
 
 func (c *Client) listenDisconnect(h func(index int)) {
 	if h != nil {
+		c.mu.Lock()
 		c.disconnectedHandler = append(c.disconnectedHandler, h)
+		c.mu.Unlock()
 	}
 }
 
 func (c *Client) HeartbeatPause() {
-	c.heartbeatPaused = true
+	c.heartbeatPaused.Store(true)
 }
 
 func (c *Client) HeartbeatContinue() {
-	c.heartbeatPaused = false
+	c.heartbeatPaused.Store(false)
 }
 
 func (c *Client) Heartbeat(pkg []byte, interval time.Duration) {
@@ -147,168 +289,331 @@ func (c *Client) Heartbeat(pkg []byte, interval time.Duration) {
 		c.heartbeat(pkg)
 		return
 	}
-	if c.conn != nil || c.wsConn != nil {
-		ctx, cancel := context.WithCancel(c.ctx)
-		if c.heartbeatCancel != nil {
-			c.heartbeatCancel()
-		}
-		c.heartbeatCancel = cancel
-		c.loopHandle(ctx, interval, func() bool {
-			if !c.heartbeatPaused {
-				c.heartbeat(pkg)
-			}
-			return true
-		})
+	if c.connection() == nil {
 		return
 	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.mu.Lock()
+	if c.heartbeatCancel != nil {
+		c.heartbeatCancel()
+	}
+	c.heartbeatCancel = cancel
+	c.mu.Unlock()
+	c.loopHandle(ctx, interval, func() bool {
+		if c.heartbeatTimeout > 0 && time.Since(time.Unix(0, c.lastReceive.Load())) > c.heartbeatTimeout {
+			cn := c.connection()
+			c.logger.Print(zapcore.WarnLevel, "heartbeat timeout", c.fields(cn)...)
+			if cn != nil {
+				cause := c.transportError(OpHeartbeat, cn, ErrHeartbeatTimeout)
+				c.endpoints.failure(cn.host, cause)
+				c.reset(cn, cause)
+			}
+			return true
+		}
+		if !c.heartbeatPaused.Load() {
+			c.heartbeat(pkg)
+		}
+		return true
+	})
 }
 
 func (c *Client) heartbeat(pkg []byte) {
-	if c.conn == nil || c.wsConn == nil {
+	cn := c.connection()
+	if cn == nil {
 		return
 	}
-	c.logWatcher(zapcore.DebugLevel, "heartbeat")
+	c.logger.Print(zapcore.DebugLevel, "heartbeat", c.fields(cn)...)
 	if err := c.Send(pkg); err != nil {
-		c.logWatcher(zapcore.ErrorLevel, "heartbeat failed,err="+err.Error())
+		c.logger.Print(zapcore.ErrorLevel, "heartbeat failed", append(c.fields(cn), zap.Error(err))...)
+		return
 	}
+	c.heartbeatSent.CompareAndSwap(0, time.Now().UnixNano())
 }
 
+// goroutine 启动受 wg 管理的协程, 停止后不再启动
+func (c *Client) goroutine(fn func()) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// callback 执行用户回调, 回调中调用 Stop 时不等待内部协程, 避免等待自身
+func (c *Client) callback(fn func()) {
+	c.callbacks.Add(1)
+	defer c.callbacks.Add(-1)
+	fn()
+}
+
+// loopHandle 每隔 interval 执行 cb, cb 返回 false 或 ctx 结束时退出
 func (c *Client) loopHandle(ctx context.Context, interval time.Duration, cb func() bool) {
-	go func(ctx1 context.Context) {
+	c.goroutine(func() {
 		for {
-			select {
-			case <-ctx1.Done():
+			if !cb() || !c.sleep(ctx, interval) {
 				return
-			default:
-				if !cb() {
-					return
-				}
-				if interval > 0 {
-					time.Sleep(interval)
-				}
 			}
 		}
-	}(ctx)
+	})
 }
 
-func (c *Client) startListen() {
-	c.logWatcher(zapcore.DebugLevel, "client listen start")
-	c.loopHandle(c.ctx, 0, func() bool {
-		if c.conn == nil && c.wsConn == nil {
-			time.Sleep(time.Millisecond * 100)
-			return true
-		}
-		var packages []byte
+// sleep 可被 ctx 打断的等待, 被打断返回 false
+func (c *Client) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// listen 连接的读协程, 连接关闭后退出, 读到数据的同时返回错误时先投递数据再断开
+func (c *Client) listen(cn *connection) {
+	var buf []byte
+	if cn.conn != nil {
+		buf = make([]byte, c.readBufferSize)
+	}
+	for {
+		var data []byte
 		var err error
-		if c.conn != nil {
-			buf := [1024]byte{}
+		if cn.conn != nil {
 			var n int
-			n, err = c.conn.Read(buf[:])
-			if err == nil && n > 0 {
-				packages = buf[:n]
-			}
+			n, err = cn.conn.Read(buf)
+			// 读缓冲在连接内复用, 复制为独立的切片, 处理函数可以持有数据
+			data = append([]byte(nil), buf[:n]...)
 		} else {
-			_, packages, err = c.wsConn.ReadMessage()
+			_, data, err = cn.wsConn.ReadMessage()
 		}
-		if err != nil {
-			var closeError *websocket.CloseError
-			if errors.Is(syscall.EINVAL, err) || errors.Is(io.EOF, err) || errors.As(err, &closeError) {
-				c.reset()
-			}
-			time.Sleep(time.Millisecond * 100)
-			return true
+		if len(data) > 0 && !c.receive(cn, data) {
+			return
 		}
-		if len(packages) > 0 {
-			c.pkgChan <- packages
+		if err != nil {
+			c.reset(cn, c.transportError(OpRead, cn, err))
+			return
 		}
+	}
+}
+
+// receive 记录接收并投递到处理队列, 连接已关闭返回 false
+func (c *Client) receive(cn *connection, data []byte) bool {
+	c.lastReceive.Store(time.Now().UnixNano())
+	c.metrics.received(cn.host, len(data))
+	// 心跳后收到的第一个包视为心跳回复
+	if sent := c.heartbeatSent.Swap(0); sent > 0 {
+		rtt := time.Since(time.Unix(0, sent))
+		c.endpoints.rtt(cn.host, rtt)
+		c.metrics.rtt(cn.host, rtt)
+	}
+	select {
+	case c.pkgChan <- &packet{data: data, cn: cn}:
+		c.metrics.queueDepth.Set(float64(len(c.pkgChan)), cn.host)
 		return true
-	})
+	case <-cn.done:
+		return false
+	}
 }
 
 func (c *Client) dispatch() {
-	c.logWatcher(zapcore.DebugLevel, "client package dispatch start")
-	go func(ctx context.Context) {
+	c.logger.Print(zapcore.DebugLevel, "client package dispatch start")
+	c.goroutine(func() {
 		for {
 			select {
-			case <-ctx.Done():
-				return
+			case <-c.ctx.Done():
+				// 停止时处理完已接收的包
+				for {
+					select {
+					case pkg := <-c.pkgChan:
+						c.handleMessage(pkg)
+					default:
+						return
+					}
+				}
 			case pkg := <-c.pkgChan:
-				c.pkgWatcher(Receive, "raw package", pkg)
-				c.messageHandler(pkg)
+				c.handleMessage(pkg)
 			}
 		}
-	}(c.ctx)
+	})
 }
 
+func (c *Client) handleMessage(pkg *packet) {
+	c.metrics.queueDepth.Set(float64(len(c.pkgChan)), pkg.cn.host)
+	// 新连接的数据不与旧连接残留的粘包数据拼接
+	if pkg.cn != c.tmpConn {
+		c.tmpConn = pkg.cn
+		c.Tmp = nil
+	}
+	c.logger.Package(Receive, "raw package", pkg.data, c.fields(pkg.cn)...)
+	c.callback(func() { c.messageHandler(pkg.data) })
+}
+
+// tryConnect 连接协程: 连接失败或断开后等待 retryInterval 重连
 func (c *Client) tryConnect() {
-	c.logWatcher(zapcore.DebugLevel, "client connect loop start")
-	c.loopHandle(c.ctx, c.retryInterval, func() bool {
-		if c.conn != nil || c.wsConn != nil {
-			return true
-		}
+	c.logger.Print(zapcore.DebugLevel, "client connect loop start")
+	c.goroutine(func() {
+		for {
+			c.state.set(Connecting, nil, c.index(true))
+			cn, err := c.connect()
+			if err != nil {
+				if c.ctx.Err() != nil {
+					return
+				}
+				c.logger.Print(zapcore.ErrorLevel, "client connect failed", append(c.fields(cn), zap.Error(err))...)
+				c.state.set(Disconnected, err, c.index(false))
+			} else {
+				c.logger.Print(zapcore.InfoLevel, "client connected", c.fields(cn)...)
+				c.triggerHandshake(cn.index)
+				c.state.set(Connected, nil, cn.index)
+				c.triggerConnected(cn.index)
+				select {
+				case <-cn.done:
+				case <-c.ctx.Done():
+					return
+				}
+			}
 
-		if err := c.connect(); err != nil {
-			c.logWatcher(zapcore.ErrorLevel, "client connect failed, err="+err.Error())
-		} else {
-			c.connectIndex++
-			c.triggerConnected(c.connectIndex)
+			if c.retryInterval == 0 {
+				c.logger.Print(zapcore.WarnLevel, "client connect loop stopped, no retry interval")
+				return
+			}
+			// 总是等待后重连, 避免对端接受后立即关闭或节点全部失败时频繁拨号
+			if !c.sleep(c.ctx, c.retryInterval) {
+				return
+			}
 		}
+	})
+}
 
-		if c.retryInterval == 0 {
-			c.logWatcher(zapcore.WarnLevel, "client connect loop stopped, no retry interval")
-			return false
+// connect 选择节点建立连接并启动该连接的读协程, 拨号失败时返回的连接仅含节点地址
+func (c *Client) connect() (*connection, error) {
+	cn := newConnection()
+	cn.host = c.endpoints.pick()
+	if cn.host == "" {
+		return nil, c.transportError(OpDial, nil, ErrNoEndpoint)
+	}
+	if err := c.dial(cn); err != nil {
+		err = c.transportError(OpDial, cn, err)
+		if c.ctx.Err() == nil {
+			c.endpoints.failure(cn.host, err)
+			c.metrics.dialFailures.Add(1, cn.host)
 		}
-		return true
-	})
+		return cn, err
+	}
+	c.endpoints.success(cn.host)
+	c.metrics.connects.Add(1, cn.host)
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		cn.close()
+		return nil, ErrStopped
+	}
+	c.connectIndex++
+	cn.index = c.connectIndex
+	cn.ctx, cn.cancel = context.WithCancel(c.ctx)
+	c.current = cn
+	c.mu.Unlock()
+
+	c.lastReceive.Store(time.Now().UnixNano())
+	c.heartbeatSent.Store(0)
+	if !c.goroutine(func() { c.listen(cn) }) {
+		c.reset(cn, ErrStopped)
+		return nil, ErrStopped
+	}
+
+	return cn, nil
 }
 
-func (c *Client) connect() error {
-	c.reset()
+func (c *Client) dial(cn *connection) error {
 	if c.network == "ws" || c.network == "wss" {
-		conn, _, err := websocket.DefaultDialer.Dial(c.network+"://"+c.host, nil)
+		dialer := c.wsDialer
+		dialer.EnableCompression = c.wsCompression
+		conn, _, err := dialer.DialContext(c.ctx, c.network+"://"+cn.host, c.wsHeader)
 		if err != nil {
 			return err
 		}
-		c.wsConn = conn
+		if c.wsReadLimit > 0 {
+			conn.SetReadLimit(c.wsReadLimit)
+		}
+		conn.EnableWriteCompression(c.wsCompression)
+		cn.wsConn = conn
 	} else {
 		dialer := net.Dialer{
 			Timeout:   c.connectTimeout,
 			KeepAlive: c.keepAlive,
 		}
-		conn, err := dialer.Dial(c.network, c.host)
+		conn, err := dialer.DialContext(c.ctx, c.network, cn.host)
 		if err != nil {
 			return err
 		}
-
-		c.conn = conn
+		cn.conn = conn
 	}
 
 	return nil
 }
 
-func (c *Client) reset() {
-	if c.conn != nil {
-		_ = c.conn.Close()
-		c.disconnectIndex++
-		c.triggerDisconnected(c.disconnectIndex)
-		c.conn = nil
+// reset 关闭连接 cn, cn 为 nil 时关闭当前连接, cause 为断开原因
+func (c *Client) reset(cn *connection, cause error) {
+	c.mu.Lock()
+	if c.current == nil || (cn != nil && cn != c.current) {
+		c.mu.Unlock()
+		return
 	}
-	if c.wsConn != nil {
-		_ = c.wsConn.Close()
-		c.disconnectIndex++
-		c.triggerDisconnected(c.disconnectIndex)
-		c.wsConn = nil
+	cn = c.current
+	c.current = nil
+	c.disconnectIndex++
+	index := c.disconnectIndex
+	c.mu.Unlock()
+
+	cn.close()
+	c.metrics.disconnects.Add(1, cn.host)
+	fields := c.fields(cn)
+	if cause != nil {
+		fields = append(fields, zap.Error(cause))
 	}
+	c.logger.Print(zapcore.InfoLevel, "client disconnected", fields...)
+	if c.State() != Draining {
+		c.state.set(Disconnected, cause, index)
+	}
+	c.triggerDisconnected(index)
+}
+
+func (c *Client) triggerHandshake(index int) {
+	c.mu.RLock()
+	handlers := c.handshakeHandler
+	c.mu.RUnlock()
+	c.callback(func() {
+		for _, h := range handlers {
+			h(index)
+		}
+	})
 }
 
 func (c *Client) triggerConnected(index int) {
-	for _, h := range c.connectedHandler {
-		h(index)
-	}
+	c.mu.RLock()
+	handlers := c.connectedHandler
+	c.mu.RUnlock()
+	c.callback(func() {
+		for _, h := range handlers {
+			h(index)
+		}
+	})
 }
 
 func (c *Client) triggerDisconnected(index int) {
-	for _, h := range c.disconnectedHandler {
-		h(index)
-	}
+	c.mu.RLock()
+	handlers := c.disconnectedHandler
+	c.mu.RUnlock()
+	c.callback(func() {
+		for _, h := range handlers {
+			h(index)
+		}
+	})
 }
@@ -2,14 +2,99 @@ package client
 
 import (
 	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// echoTcpServer 回显服务, 返回地址和已接受连接的通道
+func echoTcpServer(t *testing.T) (string, chan net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l.Addr().String(), conns
+}
+
+func echoWsServer(t *testing.T) string {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"gateway.v1"}}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func quiet() Option {
+	return func(c *Client) {
+		c.With(Logger(nil), Package(nil))
+	}
+}
+
+func waitConnected(t *testing.T, c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		t.Fatal("wait connected failed, err=", err)
+	}
+}
+
 func TestClient(t *testing.T) {
 	ctx := context.Background()
-	cc := New(ctx, "ws", "127.0.0.1:28088/wss",
+	received := make(chan string, 1)
+	cc := New(ctx, "ws", echoWsServer(t),
 		Connect(func(index int) {
 			log.Println("connect index:", index)
 		}),
@@ -20,16 +105,709 @@ func TestClient(t *testing.T) {
 			log.Println(mtp.String(), msg, string(pkg))
 		}),
 		Message(func(pkg []byte) {
-			log.Println(string(pkg))
+			received <- string(pkg)
 		}),
+		Logger(func(level zapcore.Level, msg string) {}),
+		WsHeader(http.Header{"Authorization": []string{"token"}}),
+		WsSubprotocols("gateway.v1"),
+		WsMessage(BinaryMessage),
 	)
 	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	if p := cc.Subprotocol(); p != "gateway.v1" {
+		t.Error("expect subprotocol gateway.v1, got", p)
+	}
+	if err := cc.Send([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "hello world" {
+			t.Error("expect hello world, got", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+}
+
+func TestClient_ConcurrentSend(t *testing.T) {
+	addr, _ := echoTcpServer(t)
+	var mu sync.Mutex
+	var total int
+	cc := New(context.Background(), "tcp", addr, quiet(), Message(func(pkg []byte) {
+		mu.Lock()
+		total += len(pkg)
+		mu.Unlock()
+	}))
+	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := cc.Send([]byte("ping")); err != nil {
+					t.Error(err)
+				}
+				_ = cc.State()
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := total
+		mu.Unlock()
+		if n == 20*10*4 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("not all packages echoed")
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	addr, conns := echoTcpServer(t)
+	cc := New(context.Background(), "tcp", addr, quiet(), Retry(time.Millisecond*50))
+	changes, unsubscribe := cc.Subscribe(10)
+	defer unsubscribe()
+	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	_ = (<-conns).Close()
+	var disconnected, reconnected bool
+	timeout := time.After(time.Second * 5)
+	for !reconnected {
+		select {
+		case change := <-changes:
+			if change.To == Disconnected && change.Cause != nil {
+				disconnected = true
+			}
+			if disconnected && change.To == Connected {
+				if change.Index != 2 {
+					t.Error("expect connect index 2, got", change.Index)
+				}
+				reconnected = true
+			}
+		case <-timeout:
+			t.Fatal("reconnect timeout")
+		}
+	}
+}
+
+func TestClient_Stop(t *testing.T) {
+	addr, _ := echoTcpServer(t)
+	cc := New(context.Background(), "tcp", addr, quiet())
+	cc.Start()
+	waitConnected(t, cc)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc.Stop()
+		}()
+	}
+	wg.Wait()
+
+	if s := cc.State(); s != Stopped {
+		t.Error("expect stopped, got", s)
+	}
+	if err := cc.Send([]byte("ping")); !errors.Is(err, ErrStopped) {
+		t.Error("expect ErrStopped, got", err)
+	}
+	if err := cc.WaitConnected(context.Background()); !errors.Is(err, ErrStopped) {
+		t.Error("expect ErrStopped, got", err)
+	}
+}
 
+func TestClient_Failover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	_ = l.Close()
+	addr, _ := echoTcpServer(t)
+
+	cc := New(context.Background(), "tcp", dead, quiet(), Endpoints(addr), Retry(time.Millisecond*50))
+	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	if h := cc.Host(); h != addr {
+		t.Error("expect host", addr, "got", h)
+	}
+	for _, ep := range cc.Endpoints() {
+		if ep.Host == dead && ep.Failures == 0 {
+			t.Error("expect dead endpoint failures recorded")
+		}
+	}
+}
+
+func TestEndpoints_Pick(t *testing.T) {
+	e := newEndpoints("a", "b", "c")
+	e.strategy = RoundRobin
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[e.pick()] = true
+	}
+	if len(seen) != 3 {
+		t.Error("expect round robin over 3 endpoints, got", seen)
+	}
+
+	e.strategy = Failover
+	e.failure("a", ErrNotConnected)
+	if h := e.pick(); h != "b" {
+		t.Error("expect b, got", h)
+	}
+	e.failure("b", ErrNotConnected)
+	e.failure("c", ErrNotConnected)
+	e.failure("c", ErrNotConnected)
+	if h := e.pick(); h != "a" {
+		t.Error("expect soonest penalty expiry a, got", h)
+	}
+
+	e.success("a")
+	e.success("b")
+	e.rtt("a", time.Millisecond*20)
+	e.rtt("b", time.Millisecond*10)
+	e.strategy = LowestLatency
+	if h := e.pick(); h != "b" {
+		t.Error("expect b, got", h)
+	}
+}
+
+func TestClient_ReconnectInterval(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	var mu sync.Mutex
+	accepts := 0
 	go func() {
 		for {
-			cc.Send([]byte("hello world"))
-			time.Sleep(time.Second * 5)
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepts++
+			mu.Unlock()
+			_ = conn.Close()
 		}
 	}()
-	select {}
+	cc := New(context.Background(), "tcp", l.Addr().String(), quiet(), Retry(time.Millisecond*50))
+	cc.Start()
+	time.Sleep(time.Millisecond * 500)
+	cc.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if accepts < 2 || accepts > 15 {
+		t.Error("expect about one dial per retry interval, got", accepts)
+	}
+}
+
+func TestClient_MessageRetained(t *testing.T) {
+	addr, _ := echoTcpServer(t)
+	received := make(chan []byte, 10)
+	cc := New(context.Background(), "tcp", addr, quiet(), Message(func(pkg []byte) {
+		received <- pkg
+	}))
+	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	var kept [][]byte
+	for _, msg := range []string{"first", "second", "third"} {
+		if err := cc.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case pkg := <-received:
+			kept = append(kept, pkg)
+		case <-time.After(time.Second * 5):
+			t.Fatal("receive timeout")
+		}
+	}
+	// 后续的读取不能覆盖已交给处理函数的数据
+	for i, msg := range []string{"first", "second", "third"} {
+		if string(kept[i]) != msg {
+			t.Error("expect", msg, "got", string(kept[i]))
+		}
+	}
+}
+
+// tailConn 一次 Read 同时返回剩余数据和 EOF
+type tailConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *tailConn) Read(b []byte) (int, error) {
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, io.EOF
+}
+
+func (c *tailConn) Close() error { return nil }
+
+func TestClient_ReadDataWithError(t *testing.T) {
+	cc := New(context.Background(), "tcp", "", quiet())
+	cn := newConnection()
+	cn.conn = &tailConn{data: []byte("tail")}
+	cc.listen(cn)
+	select {
+	case pkg := <-cc.pkgChan:
+		if string(pkg.data) != "tail" {
+			t.Error("expect tail, got", string(pkg.data))
+		}
+	default:
+		t.Error("expect data read with EOF delivered")
+	}
+}
+
+func TestClient_ReadBuffer(t *testing.T) {
+	addr, _ := echoTcpServer(t)
+	received := make(chan []byte, 10)
+	cc := New(context.Background(), "tcp", addr, quiet(), ReadBuffer(4), Message(func(pkg []byte) {
+		received <- pkg
+	}))
+	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	if err := cc.Send([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	var b []byte
+	for len(b) < len("hello world") {
+		select {
+		case pkg := <-received:
+			if len(pkg) > 4 {
+				t.Error("expect reads limited by buffer size, got", len(pkg))
+			}
+			b = append(b, pkg...)
+		case <-time.After(time.Second * 5):
+			t.Fatal("receive timeout")
+		}
+	}
+	if string(b) != "hello world" {
+		t.Error("expect hello world, got", string(b))
+	}
+}
+
+func TestClient_ZapLoggerKeepsCallbacks(t *testing.T) {
+	addr, _ := echoTcpServer(t)
+	var mu sync.Mutex
+	var logs, pkgs int
+	cc := New(context.Background(), "tcp", addr,
+		Logger(func(level zapcore.Level, msg string) {
+			mu.Lock()
+			logs++
+			mu.Unlock()
+		}),
+		Package(func(mtp MsgType, msg string, pkg []byte) {
+			mu.Lock()
+			pkgs++
+			mu.Unlock()
+		}),
+		ZapLogger(zap.NewNop()),
+	)
+	cc.Start()
+	waitConnected(t, cc)
+	if err := cc.Send([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	cc.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if logs == 0 || pkgs == 0 {
+		t.Error("expect callbacks set before ZapLogger kept, got", logs, pkgs)
+	}
+	l := NewLog()
+	l.UseZap(zap.NewNop())
+	if l.watcher != nil || l.pkgWatcher != nil {
+		t.Error("expect default watchers replaced by zap")
+	}
+}
+
+func TestClient_StopInHandler(t *testing.T) {
+	addr, _ := echoTcpServer(t)
+	var cc *Client
+	stopped := make(chan struct{})
+	cc = New(context.Background(), "tcp", addr, quiet(), Message(func(pkg []byte) {
+		cc.Stop()
+		close(stopped)
+	}))
+	cc.Start()
+	waitConnected(t, cc)
+	if err := cc.Send([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stop in message handler deadlocked")
+	}
+	// 回调外再次调用时等待内部协程退出
+	cc.Stop()
+	select {
+	case <-cc.Done():
+	default:
+		t.Error("expect done after stop")
+	}
+	if s := cc.State(); s != Stopped {
+		t.Error("expect stopped, got", s)
+	}
+
+	var cc1 *Client
+	stopped1 := make(chan struct{})
+	cc1 = New(context.Background(), "tcp", addr, quiet(), Connect(func(index int) {
+		cc1.Stop()
+		close(stopped1)
+	}))
+	cc1.Start()
+	select {
+	case <-stopped1:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stop in connect handler deadlocked")
+	}
+	select {
+	case <-cc1.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("internal goroutines not exited")
+	}
+	if s := cc1.State(); s != Stopped {
+		t.Error("expect stopped, got", s)
+	}
+
+	addr2, conns := echoTcpServer(t)
+	var cc2 *Client
+	stopped2 := make(chan struct{})
+	cc2 = New(context.Background(), "tcp", addr2, quiet(), Retry(time.Hour), Disconnect(func(index int) {
+		cc2.Stop()
+		close(stopped2)
+	}))
+	cc2.Start()
+	waitConnected(t, cc2)
+	_ = (<-conns).Close()
+	select {
+	case <-stopped2:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stop in disconnect handler deadlocked")
+	}
+	select {
+	case <-cc2.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("internal goroutines not exited")
+	}
+}
+
+func TestClient_WsDialOptions(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	types := make(chan int, 2)
+	closed := make(chan error, 1)
+	upgrader := websocket.Upgrader{
+		Subprotocols:      []string{"gateway.v1"},
+		EnableCompression: true,
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == "https://app.example"
+		},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		requests <- r
+		for i := 0; i < 2; i++ {
+			mt, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			types <- mt
+		}
+		// 超过客户端的读取限制, 客户端以 1009 关闭
+		_ = conn.WriteMessage(websocket.BinaryMessage, make([]byte, 64))
+		_, _, err = conn.ReadMessage()
+		closed <- err
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	jar, _ := cookiejar.New(nil)
+	jar.SetCookies(&url.URL{Scheme: "http", Host: host}, []*http.Cookie{{Name: "session", Value: "s1"}})
+	connected := make(chan struct{}, 1)
+	cc := New(context.Background(), "ws", host,
+		quiet(),
+		Connect(func(index int) {
+			connected <- struct{}{}
+		}),
+		WsHeader(http.Header{"Authorization": []string{"token"}}),
+		WsSubprotocols("gateway.v1"),
+		WsOrigin("https://app.example"),
+		WsCookieJar(jar),
+		WsCompression(true),
+		WsReadLimit(16),
+		WsMessage(BinaryMessage),
+	)
+	cc.Start()
+	defer cc.Stop()
+	select {
+	case <-connected:
+	case <-time.After(time.Second * 5):
+		t.Fatal("connect timeout")
+	}
+
+	r := <-requests
+	if v := r.Header.Get("Authorization"); v != "token" {
+		t.Error("expect authorization token, got", v)
+	}
+	if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+		t.Error("expect session cookie, got", c, err)
+	}
+	if v := r.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(v, "permessage-deflate") {
+		t.Error("expect permessage-deflate, got", v)
+	}
+	if p := cc.Subprotocol(); p != "gateway.v1" {
+		t.Error("expect subprotocol gateway.v1, got", p)
+	}
+
+	if err := cc.Send([]byte("binary")); err != nil {
+		t.Fatal(err)
+	}
+	cc.With(WsMessage(TextMessage))
+	if err := cc.Send([]byte("text")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []int{websocket.BinaryMessage, websocket.TextMessage} {
+		select {
+		case mt := <-types:
+			if mt != expect {
+				t.Error("expect message type", expect, "got", mt)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("receive timeout")
+		}
+	}
+
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Error("expect close 1009 on read limit, got", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expect close on read limit")
+	}
+}
+
+func TestClient_WsHandshakeTimeout(t *testing.T) {
+	// 接受连接但不响应握手
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	failed := make(chan string, 1)
+	cc := New(context.Background(), "ws", l.Addr().String(),
+		Logger(func(level zapcore.Level, msg string) {
+			if level == zapcore.ErrorLevel {
+				select {
+				case failed <- msg:
+				default:
+				}
+			}
+		}),
+		Package(func(mtp MsgType, msg string, pkg []byte) {}),
+		Retry(time.Hour),
+		WsHandshakeTimeout(time.Millisecond*100),
+	)
+	start := time.Now()
+	cc.Start()
+	defer cc.Stop()
+
+	select {
+	case msg := <-failed:
+		if !strings.Contains(msg, "connect failed") {
+			t.Error("expect connect failed, got", msg)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Error("expect handshake timeout about 100ms, got", d)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("handshake not timed out")
+	}
+}
+
+// silentTcpServer 接受连接但不回复任何数据
+func silentTcpServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l.Addr().String()
+}
+
+// nextChange 等待下一个状态变更
+func nextChange(t *testing.T, changes <-chan StateChange) StateChange {
+	select {
+	case change, ok := <-changes:
+		if !ok {
+			t.Fatal("state changes closed")
+		}
+		return change
+	case <-time.After(time.Second * 5):
+		t.Fatal("state change timeout")
+	}
+	return StateChange{}
+}
+
+func TestClient_StateTransitions(t *testing.T) {
+	addr, conns := echoTcpServer(t)
+	cc := New(context.Background(), "tcp", addr,
+		quiet(),
+		Retry(time.Hour),
+	)
+	if s := cc.State(); s != Idle {
+		t.Error("expect idle, got", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := cc.WaitConnected(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expect deadline exceeded before start, got", err)
+	}
+	changes, unsubscribe := cc.Subscribe(10)
+	defer unsubscribe()
+	cc.Start()
+	waitConnected(t, cc)
+
+	expect := func(from, to State) StateChange {
+		change := nextChange(t, changes)
+		if change.From != from || change.To != to {
+			t.Errorf("expect %s -> %s, got %s -> %s", from, to, change.From, change.To)
+		}
+		return change
+	}
+	expect(Idle, Connecting)
+	if change := expect(Connecting, Connected); change.Index != 1 || change.Cause != nil {
+		t.Error("expect connect index 1 without cause, got", change.Index, change.Cause)
+	}
+	_ = (<-conns).Close()
+	if change := expect(Connected, Disconnected); change.Index != 1 || !errors.Is(change.Cause, io.EOF) {
+		t.Error("expect disconnect index 1 by EOF, got", change.Index, change.Cause)
+	}
+	if s := cc.State(); s != Disconnected {
+		t.Error("expect disconnected, got", s)
+	}
+
+	cc.Stop()
+	if change := expect(Disconnected, Draining); !errors.Is(change.Cause, ErrStopped) {
+		t.Error("expect draining by stop, got", change.Cause)
+	}
+	if change := expect(Draining, Stopped); !errors.Is(change.Cause, ErrStopped) {
+		t.Error("expect stopped by stop, got", change.Cause)
+	}
+	if _, ok := <-changes; ok {
+		t.Error("expect changes closed after stopped")
+	}
+	late, _ := cc.Subscribe(1)
+	if _, ok := <-late; ok {
+		t.Error("expect closed subscription after stopped")
+	}
+	if err := cc.WaitConnected(context.Background()); !errors.Is(err, ErrStopped) {
+		t.Error("expect ErrStopped, got", err)
+	}
+}
+
+func TestClient_StateDialFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	cc := New(context.Background(), "tcp", addr,
+		quiet(),
+		Retry(time.Hour),
+	)
+	changes, unsubscribe := cc.Subscribe(10)
+	defer unsubscribe()
+	cc.Start()
+	defer cc.Stop()
+
+	if change := nextChange(t, changes); change.To != Connecting {
+		t.Error("expect connecting, got", change.To)
+	}
+	change := nextChange(t, changes)
+	var oe *net.OpError
+	if change.To != Disconnected || !errors.As(change.Cause, &oe) || oe.Op != "dial" {
+		t.Error("expect disconnected by dial error, got", change.To, change.Cause)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := cc.WaitConnected(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expect deadline exceeded, got", err)
+	}
+}
+
+func TestClient_StateHeartbeatTimeout(t *testing.T) {
+	var cc *Client
+	cc = New(context.Background(), "tcp", silentTcpServer(t),
+		quiet(),
+		Retry(time.Hour),
+		HeartbeatTimeout(time.Millisecond*100),
+		Connect(func(index int) {
+			cc.Heartbeat([]byte("ping"), time.Millisecond*20)
+		}),
+	)
+	changes, unsubscribe := cc.Subscribe(10)
+	defer unsubscribe()
+	cc.Start()
+	defer cc.Stop()
+	waitConnected(t, cc)
+
+	for {
+		change := nextChange(t, changes)
+		if change.To != Disconnected {
+			continue
+		}
+		if !errors.Is(change.Cause, ErrHeartbeatTimeout) {
+			t.Error("expect heartbeat timeout, got", change.Cause)
+		}
+		return
+	}
 }
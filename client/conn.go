@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync"
+)
+
+// connection 一次建立的连接, 读只在该连接的 listen 协程中进行, 写通过 writeLock 串行, 关闭后 done 关闭
+type connection struct {
+	host      string
+	index     int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	conn      net.Conn
+	wsConn    *websocket.Conn
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConnection() *connection {
+	return &connection{done: make(chan struct{})}
+}
+
+func (cn *connection) write(mt WsMessageType, pkg []byte) (err error) {
+	cn.writeLock.Lock()
+	defer cn.writeLock.Unlock()
+	if cn.conn != nil {
+		_, err = cn.conn.Write(pkg)
+		return
+	}
+	return cn.wsConn.WriteMessage(int(mt), pkg)
+}
+
+func (cn *connection) subprotocol() string {
+	if cn.wsConn == nil {
+		return ""
+	}
+	return cn.wsConn.Subprotocol()
+}
+
+func (cn *connection) close() {
+	cn.closeOnce.Do(func() {
+		close(cn.done)
+		if cn.cancel != nil {
+			cn.cancel()
+		}
+		if cn.conn != nil {
+			_ = cn.conn.Close()
+		} else {
+			_ = cn.wsConn.Close()
+		}
+	})
+}
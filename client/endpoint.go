@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategy 多节点选择策略
+type Strategy int
+
+const (
+	Failover      Strategy = 1 // 按顺序, 前面的节点不可用时使用后面的
+	RoundRobin    Strategy = 2 // 轮询
+	Random        Strategy = 3 // 随机
+	LowestLatency Strategy = 4 // 心跳往返时间最短, 未测得的节点优先
+)
+
+var strategyNames = map[Strategy]string{
+	Failover:      "failover",
+	RoundRobin:    "round-robin",
+	Random:        "random",
+	LowestLatency: "lowest-latency",
+}
+
+func (s Strategy) String() string {
+	return strategyNames[s]
+}
+
+// Endpoint 节点状态
+type Endpoint struct {
+	Host         string
+	Failures     int           // 连续失败次数, 连接成功后清零
+	PenaltyUntil time.Time     // 在此之前不参与选择, 除非所有节点都处于惩罚期
+	RTT          time.Duration // 最近一次心跳往返时间
+	LastError    error
+}
+
+type endpoints struct {
+	mu         sync.Mutex
+	strategy   Strategy
+	list       []*Endpoint
+	next       int
+	penalty    time.Duration
+	maxPenalty time.Duration
+	rand       *rand.Rand
+}
+
+func newEndpoints(hosts ...string) *endpoints {
+	e := &endpoints{
+		strategy:   Failover,
+		penalty:    time.Second * 5,
+		maxPenalty: time.Minute,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	e.add(hosts...)
+	return e
+}
+
+func (e *endpoints) add(hosts ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, h := range hosts {
+		if h != "" && e.find(h) == nil {
+			e.list = append(e.list, &Endpoint{Host: h})
+		}
+	}
+}
+
+// replace 替换节点列表, 保留已有节点的状态
+func (e *endpoints) replace(hosts []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]*Endpoint, 0, len(hosts))
+	for _, h := range hosts {
+		if ep := e.find(h); ep != nil {
+			list = append(list, ep)
+		} else {
+			list = append(list, &Endpoint{Host: h})
+		}
+	}
+	e.list = list
+}
+
+func (e *endpoints) find(host string) *Endpoint {
+	for _, ep := range e.list {
+		if ep.Host == host {
+			return ep
+		}
+	}
+	return nil
+}
+
+// pick 选择一个节点, 所有节点都处于惩罚期时选择最先解除的
+func (e *endpoints) pick() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.list) == 0 {
+		return ""
+	}
+	now := time.Now()
+	var healthy []*Endpoint
+	for _, ep := range e.list {
+		if !ep.PenaltyUntil.After(now) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		soonest := e.list[0]
+		for _, ep := range e.list[1:] {
+			if ep.PenaltyUntil.Before(soonest.PenaltyUntil) {
+				soonest = ep
+			}
+		}
+		return soonest.Host
+	}
+
+	switch e.strategy {
+	case RoundRobin:
+		e.next++
+		return healthy[e.next%len(healthy)].Host
+	case Random:
+		return healthy[e.rand.Intn(len(healthy))].Host
+	case LowestLatency:
+		best := healthy[0]
+		for _, ep := range healthy[1:] {
+			if ep.RTT < best.RTT {
+				best = ep
+			}
+		}
+		return best.Host
+	default:
+		return healthy[0].Host
+	}
+}
+
+func (e *endpoints) success(host string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ep := e.find(host); ep != nil {
+		ep.Failures = 0
+		ep.PenaltyUntil = time.Time{}
+		ep.LastError = nil
+	}
+}
+
+// failure 记录失败, 惩罚时间随连续失败次数翻倍
+func (e *endpoints) failure(host string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ep := e.find(host); ep != nil {
+		ep.Failures++
+		ep.LastError = err
+		penalty := e.penalty << (ep.Failures - 1)
+		if penalty <= 0 || penalty > e.maxPenalty {
+			penalty = e.maxPenalty
+		}
+		ep.PenaltyUntil = time.Now().Add(penalty)
+	}
+}
+
+func (e *endpoints) rtt(host string, d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ep := e.find(host); ep != nil {
+		ep.RTT = d
+	}
+}
+
+func (e *endpoints) snapshot() []Endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]Endpoint, len(e.list))
+	for i, ep := range e.list {
+		list[i] = *ep
+	}
+	return list
+}
+
+// srv SRV 记录发现配置
+type srv struct {
+	service  string
+	proto    string
+	name     string
+	refresh  time.Duration
+	resolver *net.Resolver
+}
+
+func (s *srv) lookup(ctx context.Context) ([]string, error) {
+	_, addrs, err := s.resolver.LookupSRV(ctx, s.service, s.proto, s.name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port))))
+	}
+	return hosts, nil
+}
+
+// Endpoints 所有节点的状态
+func (c *Client) Endpoints() []Endpoint {
+	return c.endpoints.snapshot()
+}
+
+// discover 解析 SRV 记录更新节点列表, 并按 refresh 周期刷新
+func (c *Client) discover() {
+	if c.srv == nil {
+		return
+	}
+	resolve := func() bool {
+		ctx, cancel := context.WithTimeout(c.ctx, c.connectTimeout)
+		defer cancel()
+		hosts, err := c.srv.lookup(ctx)
+		if err != nil {
+			c.logger.Print(zapcore.ErrorLevel, "client srv lookup failed", zap.String("service", c.srv.service), zap.String("name", c.srv.name), zap.Error(err))
+			return true
+		}
+		if len(hosts) > 0 {
+			c.endpoints.replace(hosts)
+		}
+		return true
+	}
+	resolve()
+	if c.srv.refresh > 0 {
+		c.goroutine(func() {
+			for c.sleep(c.ctx, c.srv.refresh) {
+				resolve()
+			}
+		})
+	}
+}
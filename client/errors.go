@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// 出错的连接操作
+const (
+	OpDial      = "dial"
+	OpRead      = "read"
+	OpWrite     = "write"
+	OpHeartbeat = "heartbeat"
+)
+
+// TransportError 连接层错误, 除客户端停止外均可通过重连重试
+type TransportError struct {
+	Op      string
+	Network string
+	Host    string
+	Err     error
+}
+
+func (c *Client) transportError(op string, cn *connection, err error) error {
+	e := &TransportError{Op: op, Network: c.network, Err: err}
+	if cn != nil {
+		e.Host = cn.host
+	}
+	return e
+}
+
+func (e *TransportError) Error() string {
+	s := "client error: " + e.Op
+	if e.Host != "" {
+		s += " " + e.Network + "://" + e.Host
+	}
+	return s + " failed, err=" + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Temporary() bool {
+	return !errors.Is(e.Err, ErrStopped) && !errors.Is(e.Err, context.Canceled)
+}
+
+// Timeout 是否为超时错误
+func (e *TransportError) Timeout() bool {
+	var ne net.Error
+	return errors.Is(e.Err, ErrHeartbeatTimeout) || errors.Is(e.Err, context.DeadlineExceeded) || errors.As(e.Err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"log"
+	"strings"
+	"time"
+)
+
+// 日志字段名
+const (
+	FieldHost    = "host"
+	FieldNetwork = "network"
+	FieldIndex   = "index"
+	FieldType    = "type"
+	FieldSize    = "size"
+	FieldPackage = "package"
+)
+
+// Log 结构化日志, 同时输出到 zap 和字符串日志回调, 上层客户端可复用并追加自己的字段
+type Log struct {
+	zap        *zap.Logger
+	pkgZap     *zap.Logger
+	sample     func(core zapcore.Core) zapcore.Core
+	watcher    func(level zapcore.Level, msg string)
+	pkgWatcher func(mtp MsgType, msg string, pkg []byte)
+	// 回调由选项设置, 不是默认的标准库日志
+	customWatcher    bool
+	customPkgWatcher bool
+}
+
+// UseZap 设置 zap 并关闭仍为默认的标准库日志回调
+func (l *Log) UseZap(z *zap.Logger) {
+	l.zap = z
+	if !l.customWatcher {
+		l.watcher = nil
+	}
+	if !l.customPkgWatcher {
+		l.pkgWatcher = nil
+	}
+	l.build()
+}
+
+func NewLog() *Log {
+	return &Log{
+		watcher: func(level zapcore.Level, msg string) {
+			log.Println(msg)
+		},
+		pkgWatcher: func(mtp MsgType, msg string, pkg []byte) {
+			log.Println(mtp.String(), len(pkg), "types pkg:", pkg)
+		},
+	}
+}
+
+// SetWatcher 设置字符串日志回调, nil 为不输出
+func (l *Log) SetWatcher(watcher func(level zapcore.Level, msg string)) {
+	if watcher == nil {
+		watcher = func(level zapcore.Level, msg string) {}
+	}
+	l.watcher = watcher
+	l.customWatcher = true
+}
+
+// SetPackageWatcher 设置包日志回调, nil 为不输出
+func (l *Log) SetPackageWatcher(watcher func(mtp MsgType, msg string, pkg []byte)) {
+	if watcher == nil {
+		watcher = func(mtp MsgType, msg string, pkg []byte) {}
+	}
+	l.pkgWatcher = watcher
+	l.customPkgWatcher = true
+}
+
+// Zap 当前使用的 zap, 未设置时为 nil
+func (l *Log) Zap() *zap.Logger {
+	return l.zap
+}
+
+// Sampling zap 包日志采样
+func (l *Log) Sampling(tick time.Duration, first, thereafter int) {
+	l.sample = func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, tick, first, thereafter)
+	}
+	l.build()
+}
+
+// build 包日志按 sampling 采样
+func (l *Log) build() {
+	l.pkgZap = l.zap
+	if l.zap != nil && l.sample != nil {
+		l.pkgZap = l.zap.WithOptions(zap.WrapCore(l.sample))
+	}
+}
+
+// Print 输出到 zap 和字符串日志回调
+func (l *Log) Print(level zapcore.Level, msg string, fields ...zap.Field) {
+	if l.zap != nil {
+		if ce := l.zap.Check(level, msg); ce != nil {
+			ce.Write(fields...)
+		}
+	}
+	if l.watcher != nil {
+		l.watcher(level, FormatFields(msg, fields))
+	}
+}
+
+// Package 包日志, 按 Sampling 采样
+func (l *Log) Package(mtp MsgType, msg string, pkg []byte, fields ...zap.Field) {
+	if l.pkgZap != nil {
+		if ce := l.pkgZap.Check(zapcore.DebugLevel, msg); ce != nil {
+			ce.Write(append(fields, zap.Stringer(FieldType, mtp), zap.Int(FieldSize, len(pkg)), zap.Binary(FieldPackage, pkg))...)
+		}
+	}
+	if l.pkgWatcher != nil {
+		l.pkgWatcher(mtp, msg, pkg)
+	}
+}
+
+// FormatFields 将字段以 key=value 追加到消息后, 用于字符串日志回调
+func FormatFields(msg string, fields []zap.Field) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		f.AddTo(enc)
+		if v, ok := enc.Fields[f.Key]; ok {
+			b.WriteString(", " + f.Key + "=" + fmt.Sprint(v))
+		}
+	}
+	return b.String()
+}
+
+// Log 客户端使用的日志
+func (c *Client) Log() *Log {
+	return c.logger
+}
+
+// fields 连接相关的日志字段
+func (c *Client) fields(cn *connection) []zap.Field {
+	fields := []zap.Field{zap.String(FieldNetwork, c.network)}
+	if cn != nil {
+		fields = append(fields, zap.String(FieldHost, cn.host), zap.Int(FieldIndex, cn.index))
+	}
+	return fields
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"github.com/obnahsgnaw/socketutil/metrics"
+	"time"
+)
+
+// 客户端指标名称
+const (
+	MetricConnects      = "socket_client_connects_total"
+	MetricDisconnects   = "socket_client_disconnects_total"
+	MetricDialFailures  = "socket_client_dial_failures_total"
+	MetricSentBytes     = "socket_client_sent_bytes_total"
+	MetricSentPkgs      = "socket_client_sent_packages_total"
+	MetricReceivedBytes = "socket_client_received_bytes_total"
+	MetricReceivedPkgs  = "socket_client_received_packages_total"
+	MetricQueueDepth    = "socket_client_queue_depth"
+	MetricHeartbeatRTT  = "socket_client_heartbeat_rtt_seconds"
+)
+
+type clientMetrics struct {
+	connects      metrics.Counter
+	disconnects   metrics.Counter
+	dialFailures  metrics.Counter
+	sentBytes     metrics.Counter
+	sentPkgs      metrics.Counter
+	receivedBytes metrics.Counter
+	receivedPkgs  metrics.Counter
+	queueDepth    metrics.Gauge
+	heartbeatRTT  metrics.Histogram
+}
+
+func newClientMetrics(m metrics.Metrics) *clientMetrics {
+	if m == nil {
+		m = metrics.Nop
+	}
+	return &clientMetrics{
+		connects:      m.Counter(MetricConnects, "Number of established connections.", "host"),
+		disconnects:   m.Counter(MetricDisconnects, "Number of closed connections.", "host"),
+		dialFailures:  m.Counter(MetricDialFailures, "Number of failed dials.", "host"),
+		sentBytes:     m.Counter(MetricSentBytes, "Bytes written to the connection.", "host"),
+		sentPkgs:      m.Counter(MetricSentPkgs, "Packages written to the connection.", "host"),
+		receivedBytes: m.Counter(MetricReceivedBytes, "Bytes read from the connection.", "host"),
+		receivedPkgs:  m.Counter(MetricReceivedPkgs, "Packages read from the connection.", "host"),
+		queueDepth:    m.Gauge(MetricQueueDepth, "Received packages waiting for dispatch.", "host"),
+		heartbeatRTT:  m.Histogram(MetricHeartbeatRTT, "Heartbeat round trip time in seconds.", metrics.DefBuckets, "host"),
+	}
+}
+
+func (m *clientMetrics) sent(host string, n int) {
+	m.sentPkgs.Add(1, host)
+	m.sentBytes.Add(float64(n), host)
+}
+
+func (m *clientMetrics) received(host string, n int) {
+	m.receivedPkgs.Add(1, host)
+	m.receivedBytes.Add(float64(n), host)
+}
+
+func (m *clientMetrics) rtt(host string, d time.Duration) {
+	m.heartbeatRTT.Observe(d.Seconds(), host)
+}
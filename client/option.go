@@ -1,7 +1,11 @@
 package client
 
 import (
+	"github.com/obnahsgnaw/socketutil/metrics"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"net"
+	"net/http"
 	"time"
 )
 
@@ -25,21 +29,55 @@ func Keepalive(interval time.Duration) Option {
 	}
 }
 
-func Logger(watcher func(level zapcore.Level, msg string)) Option {
+// HeartbeatTimeout 超过 timeout 未收到任何数据则断开连接并重连, 需配合 Heartbeat 使用
+func HeartbeatTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.heartbeatTimeout = timeout
+	}
+}
+
+// ReadBuffer tcp/udp 单次读取的缓冲大小, 默认 1024, udp 需大于最大报文长度
+func ReadBuffer(size int) Option {
 	return func(client *Client) {
-		if watcher == nil {
-			watcher = func(level zapcore.Level, msg string) {}
+		if size > 0 {
+			client.readBufferSize = size
 		}
-		client.logWatcher = watcher
 	}
 }
 
-func Package(watcher func(mtp MsgType, msg string, pkg []byte)) Option {
+// Queue 接收包的队列长度, 默认 10, 队列满时读协程阻塞
+func Queue(size int) Option {
 	return func(client *Client) {
-		if watcher == nil {
-			watcher = func(mtp MsgType, msg string, pkg []byte) {}
+		if size > 0 {
+			client.pkgChan = make(chan *packet, size)
 		}
-		client.pkgWatcher = watcher
+	}
+}
+
+func Logger(watcher func(level zapcore.Level, msg string)) Option {
+	return func(client *Client) {
+		client.logger.SetWatcher(watcher)
+	}
+}
+
+// ZapLogger 以 zap 输出带 host、network、index 等字段的结构化日志, 并关闭默认的标准库日志回调,
+// 通过 Logger、Package 设置的回调不论选项先后都仍会收到日志
+func ZapLogger(l *zap.Logger) Option {
+	return func(client *Client) {
+		client.logger.UseZap(l)
+	}
+}
+
+// PackageSampling zap 包日志采样, 每 tick 内相同消息只记录前 first 条, 之后每 thereafter 条记录一条
+func PackageSampling(tick time.Duration, first, thereafter int) Option {
+	return func(client *Client) {
+		client.logger.Sampling(tick, first, thereafter)
+	}
+}
+
+func Package(watcher func(mtp MsgType, msg string, pkg []byte)) Option {
+	return func(client *Client) {
+		client.logger.SetPackageWatcher(watcher)
 	}
 }
 
@@ -49,14 +87,135 @@ func Connect(handler func(index int)) Option {
 	}
 }
 
+// Handshake 连接建立后、进入 Connected 状态和 Connect 回调之前执行, 用于协议协商等
+func Handshake(handler func(index int)) Option {
+	return func(client *Client) {
+		client.listenHandshake(handler)
+	}
+}
+
 func Disconnect(handler func(index int)) Option {
 	return func(client *Client) {
 		client.listenDisconnect(handler)
 	}
 }
 
+// Message 消息处理, 每个 pkg 为独立的切片, 处理函数可以持有
 func Message(handler func(pkg []byte)) Option {
 	return func(client *Client) {
 		client.messageHandler = handler
 	}
 }
+
+// WsHeader websocket 握手请求头, 如鉴权 token
+func WsHeader(header http.Header) Option {
+	return func(client *Client) {
+		for k, v := range header {
+			client.wsHeader[k] = append(client.wsHeader[k], v...)
+		}
+	}
+}
+
+// WsSubprotocols websocket 协商的子协议 Sec-WebSocket-Protocol
+func WsSubprotocols(protocols ...string) Option {
+	return func(client *Client) {
+		client.wsDialer.Subprotocols = protocols
+	}
+}
+
+// WsOrigin websocket 握手的 Origin
+func WsOrigin(origin string) Option {
+	return func(client *Client) {
+		if origin == "" {
+			client.wsHeader.Del("Origin")
+			return
+		}
+		client.wsHeader.Set("Origin", origin)
+	}
+}
+
+// WsCookieJar websocket 握手使用的 cookie jar
+func WsCookieJar(jar http.CookieJar) Option {
+	return func(client *Client) {
+		client.wsDialer.Jar = jar
+	}
+}
+
+// WsHandshakeTimeout websocket 握手超时
+func WsHandshakeTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.wsDialer.HandshakeTimeout = timeout
+	}
+}
+
+// WsReadLimit websocket 单条消息的最大字节数, <=0 不限制
+func WsReadLimit(limit int64) Option {
+	return func(client *Client) {
+		client.wsReadLimit = limit
+	}
+}
+
+// WsCompression websocket per-message deflate 压缩
+func WsCompression(enable bool) Option {
+	return func(client *Client) {
+		client.wsCompression = enable
+	}
+}
+
+// WsMessage websocket 发送的消息类型 TextMessage 或 BinaryMessage
+func WsMessage(mt WsMessageType) Option {
+	return func(client *Client) {
+		client.SetWsMessageType(mt)
+	}
+}
+
+// Endpoints 追加候选节点, 与 New 的 host 一起按 Balance 策略选择
+func Endpoints(hosts ...string) Option {
+	return func(client *Client) {
+		client.endpoints.add(hosts...)
+	}
+}
+
+// Balance 多节点选择策略, 默认 Failover
+func Balance(strategy Strategy) Option {
+	return func(client *Client) {
+		if _, ok := strategyNames[strategy]; ok {
+			client.endpoints.strategy = strategy
+		}
+	}
+}
+
+// EndpointPenalty 节点失败后的惩罚时间, 连续失败时翻倍, 最大 maxPenalty
+func EndpointPenalty(penalty, maxPenalty time.Duration) Option {
+	return func(client *Client) {
+		if penalty > 0 {
+			client.endpoints.penalty = penalty
+		}
+		if maxPenalty >= penalty {
+			client.endpoints.maxPenalty = maxPenalty
+		}
+	}
+}
+
+// SRV 通过 _service._proto.name 的 SRV 记录发现节点, refresh > 0 时周期刷新, resolver 为空使用默认解析器
+func SRV(service, proto, name string, refresh time.Duration, resolver *net.Resolver) Option {
+	return func(client *Client) {
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		client.srv = &srv{
+			service:  service,
+			proto:    proto,
+			name:     name,
+			refresh:  refresh,
+			resolver: resolver,
+		}
+	}
+}
+
+// Metrics 连接、收发、队列和心跳指标, 为空不记录
+func Metrics(m metrics.Metrics) Option {
+	return func(client *Client) {
+		client.metrics = newClientMetrics(m)
+	}
+}
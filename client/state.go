@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// State 连接状态
+type State int
+
+const (
+	Idle         State = 0
+	Connecting   State = 1
+	Connected    State = 2
+	Draining     State = 3
+	Disconnected State = 4
+	Stopped      State = 5
+)
+
+var stateNames = map[State]string{
+	Idle:         "idle",
+	Connecting:   "connecting",
+	Connected:    "connected",
+	Draining:     "draining",
+	Disconnected: "disconnected",
+	Stopped:      "stopped",
+}
+
+func (s State) String() string {
+	return stateNames[s]
+}
+
+var (
+	ErrStopped          = errors.New("client error: client stopped")
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+)
+
+// StateChange 状态变更, Cause 为变更原因: 连接错误, io.EOF, ErrHeartbeatTimeout, ErrStopped 等, Index 为连接或断开的序号
+type StateChange struct {
+	From  State
+	To    State
+	Cause error
+	Index int
+}
+
+type stateMachine struct {
+	mu          sync.Mutex
+	state       State
+	changed     chan struct{}
+	subscribers map[int]chan StateChange
+	subIndex    int
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		state:       Idle,
+		changed:     make(chan struct{}),
+		subscribers: make(map[int]chan StateChange),
+	}
+}
+
+func (s *stateMachine) get() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *stateMachine) set(to State, cause error, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == to || s.state == Stopped || (s.state == Draining && to != Stopped) {
+		return
+	}
+	change := StateChange{From: s.state, To: to, Cause: cause, Index: index}
+	s.state = to
+	close(s.changed)
+	s.changed = make(chan struct{})
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+	if to == Stopped {
+		for id, ch := range s.subscribers {
+			close(ch)
+			delete(s.subscribers, id)
+		}
+	}
+}
+
+func (s *stateMachine) subscribe(size int) (<-chan StateChange, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan StateChange, size)
+	if s.state == Stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	s.subIndex++
+	id := s.subIndex
+	s.subscribers[id] = ch
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[id]; ok {
+			close(ch)
+			delete(s.subscribers, id)
+		}
+	}
+}
+
+func (s *stateMachine) wait(ctx context.Context, target State) error {
+	for {
+		s.mu.Lock()
+		state, changed := s.state, s.changed
+		s.mu.Unlock()
+		if state == target {
+			return nil
+		}
+		if state == Stopped {
+			return ErrStopped
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// State 当前连接状态
+func (c *Client) State() State {
+	return c.state.get()
+}
+
+// Subscribe 订阅状态变更, size 为通道缓冲大小, 缓冲满时丢弃变更; 返回取消订阅函数, 客户端停止后通道关闭
+func (c *Client) Subscribe(size int) (<-chan StateChange, func()) {
+	return c.state.subscribe(size)
+}
+
+// WaitConnected 阻塞直到连接成功, ctx 结束或客户端停止
+func (c *Client) WaitConnected(ctx context.Context) error {
+	return c.state.wait(ctx, Connected)
+}
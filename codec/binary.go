@@ -0,0 +1,117 @@
+package codec
+
+// binaryFormat msgpack、cbor 等以 map 编码包的二进制格式, 由 marshal/unmarshal 函数区分
+type binaryFormat struct {
+	name      Name
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(b []byte, v interface{}) error
+	isMap     func(b []byte) bool
+	setMeta   func(b []byte, meta Meta) ([]byte, error)
+}
+
+// newBinaryFormat R 为格式的原始消息类型, 写入元数据时保留包的其他字段原样
+func newBinaryFormat[R ~[]byte](name Name, marshal func(v interface{}) ([]byte, error), unmarshal func(b []byte, v interface{}) error, isMap func(b []byte) bool) *binaryFormat {
+	f := &binaryFormat{name: name, marshal: marshal, unmarshal: unmarshal, isMap: isMap}
+	// 包为 map 且没有 meta 字段时写入元数据
+	f.setMeta = func(b []byte, meta Meta) ([]byte, error) {
+		if len(meta) == 0 || !isMap(b) {
+			return b, nil
+		}
+		var fields map[string]R
+		if err := unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+		if _, ok := fields["meta"]; ok {
+			return b, nil
+		}
+		mb, err := marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		fields["meta"] = R(mb)
+		return marshal(fields)
+	}
+	return f
+}
+
+type binaryMeta struct {
+	Meta Meta `msgpack:"meta" cbor:"meta"`
+}
+
+func (f *binaryFormat) getMeta(b []byte) Meta {
+	var m binaryMeta
+	_ = f.unmarshal(b, &m)
+	return m.Meta
+}
+
+type binaryDataBuilder struct {
+	format *binaryFormat
+}
+
+func (pb *binaryDataBuilder) Name() Name {
+	return pb.format.name
+}
+func (pb *binaryDataBuilder) Unpack(b []byte, p DataPtr) (err error) {
+	if len(b) == 0 || p == nil {
+		return
+	}
+	return NewBuilderError(DataBuilderKind, pb.format.name, OpUnpack, pb.format.unmarshal(b, p))
+}
+func (pb *binaryDataBuilder) Pack(p DataPtr) (b []byte, err error) {
+	if p == nil {
+		return
+	}
+	b, err = pb.format.marshal(p)
+	return b, NewBuilderError(DataBuilderKind, pb.format.name, OpPack, err)
+}
+
+// BinaryPackageBuilder msgpack、cbor 包构建器, 元数据写入包的 meta 字段
+type BinaryPackageBuilder struct {
+	format *binaryFormat
+	gen    func(*PKG) DataPtr
+	to     func(DataPtr) *PKG
+}
+
+// Unpack 拆包
+func (pp *BinaryPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
+	if len(b) == 0 {
+		return
+	}
+	p1 := pp.gen(&PKG{})
+	if p1 == nil {
+		err = unpackErr(ErrDataNil)
+		return
+	}
+	if err = pp.format.unmarshal(b, p1); err != nil {
+		err = unpackErr(err)
+	}
+
+	p = pp.to(p1)
+	if p != nil && len(p.Meta) == 0 {
+		p.Meta = pp.format.getMeta(b)
+	}
+
+	return
+}
+
+// Pack 封包
+func (pp *BinaryPackageBuilder) Pack(p *PKG) (b []byte, err error) {
+	if p == nil {
+		err = packErr(ErrDataNil)
+		return
+	}
+	p1 := pp.gen(p)
+	if p1 == nil {
+		err = packErr(ErrDataNil)
+		return
+	}
+	if b, err = pp.format.marshal(p1); err != nil {
+		err = packErr(err)
+		return
+	}
+	if b, err = pp.format.setMeta(b, p.Meta); err != nil {
+		err = packErr(err)
+	}
+
+	return
+}
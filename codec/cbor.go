@@ -0,0 +1,21 @@
+package codec
+
+import (
+	"github.com/fxamacker/cbor/v2"
+)
+
+var cborFormat = newBinaryFormat[cbor.RawMessage](Cbor, cbor.Marshal, cbor.Unmarshal, isCborMap)
+
+func NewCborDataBuilder() DataBuilder {
+	return &binaryDataBuilder{format: cborFormat}
+}
+
+// NewCborPackageBuilder CBOR 包构建器
+func NewCborPackageBuilder(toData func(*PKG) DataPtr, toPKG func(DataPtr) *PKG) *BinaryPackageBuilder {
+	return &BinaryPackageBuilder{format: cborFormat, gen: toData, to: toPKG}
+}
+
+// isCborMap major type 5, 0xa0-0xbb 定长 map, 0xbf 不定长 map
+func isCborMap(b []byte) bool {
+	return len(b) > 0 && (b[0] >= 0xa0 && b[0] <= 0xbb || b[0] == 0xbf)
+}
@@ -131,8 +131,8 @@ func NewLengthCodec(magicNumber uint16, bodyMax int) Codec {
 }
 
 var (
-	ErrPkgTooLong      = errors.New("codec error: Codec encode package failed, package too long. ")
-	ErrInvalidMagicNum = errors.New("codec error: Codec decode package failed, invalid magic number ")
+	ErrPkgTooLong      = errors.New("package too long")
+	ErrInvalidMagicNum = errors.New("invalid magic number")
 )
 
 func (codec *lengthCodec) Marshal(b []byte) (d []byte, err error) {
@@ -141,7 +141,7 @@ func (codec *lengthCodec) Marshal(b []byte) (d []byte, err error) {
 		return
 	}
 	if len(b) > codec.bodyMaxSize {
-		err = ErrPkgTooLong
+		err = &CodecError{Op: OpMarshal, Err: ErrPkgTooLong}
 		return
 	}
 	bodyOffset := codec.magicNumberSize + codec.bodySize
@@ -171,7 +171,7 @@ func (codec *lengthCodec) Unmarshal(b []byte, handler PkgHandler) (tmp []byte, e
 		// 比较头数据验证
 		if codec.magicNumberSize > 0 && !bytes.Equal(codec.magicNumberBytes, b[:codec.magicNumberSize]) {
 			tmp = b
-			err = ErrInvalidMagicNum
+			err = &CodecError{Op: OpUnmarshal, Err: ErrInvalidMagicNum}
 			return
 		}
 
@@ -179,7 +179,7 @@ func (codec *lengthCodec) Unmarshal(b []byte, handler PkgHandler) (tmp []byte, e
 		bodyLen := binary.BigEndian.Uint32(b[codec.magicNumberSize:bodyOffset])
 		if bodyLen > uint32(codec.bodyMaxSize) {
 			tmp = b
-			err = ErrPkgTooLong
+			err = &CodecError{Op: OpUnmarshal, Err: ErrPkgTooLong}
 			return
 		}
 		msgLen := bodyOffset + int(bodyLen)
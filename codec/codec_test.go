@@ -1,8 +1,16 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -17,3 +25,399 @@ func TestLengthCodec_Marshal(t *testing.T) {
 	binary.BigEndian.PutUint16(magicNumberBytes, 0xAB)
 	println(magicNumberBytes)
 }
+
+func TestActionRegistry(t *testing.T) {
+	r := NewActionRegistry()
+	r.MustRegister(ActionDefinition{Action: NewAction(1, "hello")})
+	if err := r.Register(ActionDefinition{Action: NewAction(1, "other")}); !errors.Is(err, ErrDuplicateAction) {
+		t.Error("expect duplicate id error, got", err)
+	}
+	if err := r.Register(ActionDefinition{Action: NewAction(2, "hello")}); !errors.Is(err, ErrDuplicateAction) {
+		t.Error("expect duplicate name error, got", err)
+	}
+	if err := r.LoadCatalog(strings.NewReader("- id: 10\n  name: login\n- {id: 11, name: logout}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LoadCatalog(strings.NewReader(`[{"id": 12, "name": "ping"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if a := r.Action(11); a.Name != "logout" {
+		t.Error("expect logout, got", a)
+	}
+	r = NewActionRegistry()
+	if err := r.RegisterEnum(descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Descriptor()); err != nil {
+		t.Fatal(err)
+	}
+	if def, ok := r.LookupName("TYPE_STRING"); !ok || def.Action.Id != 9 {
+		t.Error("expect enum value TYPE_STRING registered as 9, got", def.Action)
+	}
+	if err := r.Bind(100, nil, nil); !errors.Is(err, ErrUnknownAction) {
+		t.Error("expect unknown action error, got", err)
+	}
+}
+
+type jsonEnvelope struct {
+	Action uint32 `json:"action"`
+	Data   []byte `json:"data"`
+}
+
+func TestJsonPackageBuilder_Meta(t *testing.T) {
+	pgb := NewJsonPackageBuilder(func(p *PKG) DataPtr {
+		return &jsonEnvelope{Action: p.Action.Val(), Data: p.Data}
+	}, func(d DataPtr) *PKG {
+		e := d.(*jsonEnvelope)
+		return &PKG{Action: ActionId(e.Action), Data: e.Data}
+	})
+	p := &PKG{Action: 1, Data: []byte("hello")}
+	p.SetMeta(MetaTraceParent, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	b, err := pgb.Pack(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := pgb.Unpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1.Action != 1 || string(p1.Data) != "hello" || p1.GetMeta(MetaTraceParent) != p.GetMeta(MetaTraceParent) {
+		t.Error("unexpected package", p1)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, err := NewLengthCodec(0x1234, 4).Marshal([]byte("too long"))
+	var ce *CodecError
+	if !errors.As(err, &ce) || ce.Op != OpMarshal || !errors.Is(err, ErrPkgTooLong) {
+		t.Error("expect codec marshal error, got", err)
+	}
+	if IsTemporary(err) {
+		t.Error("codec error should not be temporary")
+	}
+
+	_, err = NewProtobufPackageBuilder(func(p *PKG) DataPtr { return &struct{}{} }, nil).Unpack([]byte{1})
+	var be *BuilderError
+	if !errors.As(err, &be) || be.Kind != PkgBuilderKind || be.Op != OpUnpack || !errors.Is(err, ErrNotAProtobufMessage) {
+		t.Error("expect pkg builder unpack error, got", err)
+	}
+
+	err = NewJsonDataBuilder().Unpack([]byte("{"), &struct{}{})
+	if !errors.As(err, &be) || be.Kind != DataBuilderKind || be.Name != Json || be.Op != OpUnpack {
+		t.Error("expect json data builder unpack error, got", err)
+	}
+}
+
+type binaryEnvelope struct {
+	Action uint32 `msgpack:"action" cbor:"action"`
+	Data   []byte `msgpack:"data" cbor:"data"`
+}
+
+func TestBinaryPackageBuilders(t *testing.T) {
+	toData := func(p *PKG) DataPtr { return &binaryEnvelope{Action: p.Action.Val(), Data: p.Data} }
+	toPKG := func(d DataPtr) *PKG {
+		e := d.(*binaryEnvelope)
+		return &PKG{Action: ActionId(e.Action), Data: e.Data}
+	}
+	type hello struct {
+		Name string `msgpack:"name" cbor:"name"`
+	}
+	for _, name := range []Name{Msgpack, Cbor} {
+		dbd := DefaultDataBuilderProvider.Provider(name)
+		if dbd.Name() != name {
+			t.Fatal("expect data builder", name, "got", dbd.Name())
+		}
+		data, err := dbd.Pack(&hello{Name: "world"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, pgb := NewWssProvider(toData, toPKG).GetByName(name)
+		b, err := pgb.Pack(&PKG{Action: 3, Data: data, Meta: Meta{MetaTenant: "t1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wp := NewWssProvider(toData, toPKG)
+		if detected, _, _, _ := wp.ParseByPackage(b); detected != Proto {
+			t.Error("expect proto without map rules, got", detected)
+		}
+		wp.Detector().Add(MapRules(0)...)
+		detected, _, _, rest := wp.ParseByPackage(b)
+		if detected != name || len(rest) != len(b) {
+			t.Error("expect detected", name, "got", detected)
+		}
+		if detected, _, _, _ = NewTcpProvider(toData, toPKG).ParseByPackage(append([]byte(name[:1]), b...)); detected != name {
+			t.Error("expect tag detected", name, "got", detected)
+		}
+		p, err := pgb.Unpack(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h hello
+		if err = dbd.Unpack(p.Data, &h); err != nil {
+			t.Fatal(err)
+		}
+		if p.Action != 3 || h.Name != "world" || p.GetMeta(MetaTenant) != "t1" {
+			t.Errorf("%s round trip failed: %+v %+v", name, p, h)
+		}
+	}
+}
+
+func TestProtojsonBuilders(t *testing.T) {
+	field := &descriptorpb.FieldDescriptorProto{
+		JsonName: proto.String("x"),
+		Type:     descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(),
+	}
+	b, err := NewProtojsonDataBuilder(UseProtoNames()).Pack(field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); !strings.Contains(s, `"json_name"`) || !strings.Contains(s, `"TYPE_INT64"`) {
+		t.Error("unexpected protojson", s)
+	}
+	if err = NewProtojsonDataBuilder().Unpack([]byte(`{"unknown":1}`), &descriptorpb.FieldDescriptorProto{}); err == nil {
+		t.Error("expect unknown field error")
+	}
+	if err = NewProtojsonDataBuilder(DiscardUnknown()).Unpack([]byte(`{"unknown":1}`), &descriptorpb.FieldDescriptorProto{}); err != nil {
+		t.Error(err)
+	}
+
+	pgb := NewPrototextPackageBuilder(func(p *PKG) DataPtr {
+		return &descriptorpb.FieldDescriptorProto{Number: proto.Int32(int32(p.Action)), JsonName: proto.String(string(p.Data))}
+	}, func(d DataPtr) *PKG {
+		f := d.(*descriptorpb.FieldDescriptorProto)
+		return &PKG{Action: ActionId(f.GetNumber()), Data: []byte(f.GetJsonName())}
+	})
+	b, err = pgb.Pack(&PKG{Action: 7, Data: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := pgb.Unpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Action != 7 || string(p.Data) != "hello" {
+		t.Errorf("prototext round trip failed: %s %+v", b, p)
+	}
+}
+
+func TestDynamicDescriptors(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("hello.proto"),
+		Package: proto.String("demo"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Hello"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), JsonName: proto.String("name")},
+				{Name: proto.String("id"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), JsonName: proto.String("id")},
+			},
+		}},
+	}}}
+	b, _ := proto.Marshal(set)
+	types, err := LoadDescriptorSet(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewActionRegistry()
+	r.UseDescriptors(types)
+	if err = r.LoadCatalog(strings.NewReader("- {id: 1, name: hello, request: demo.Hello, response: demo.Hello}")); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.LoadCatalog(strings.NewReader("- {id: 2, name: bad, request: demo.Missing}")); !errors.Is(err, ErrUnknownMessage) {
+		t.Error("expect unknown message error, got", err)
+	}
+	def, ok := r.Lookup(1)
+	if !ok || def.Request == nil {
+		t.Fatal("expect dynamic request structure")
+	}
+
+	dbd := NewDynamicDataBuilder(types, ProtoJson)
+	rq := def.Request()
+	if err = dbd.Unpack([]byte(`{"name":"world","id":"42"}`), rq); err != nil {
+		t.Fatal(err)
+	}
+	m := rq.(proto.Message).ProtoReflect()
+	if m.Get(m.Descriptor().Fields().ByName("name")).String() != "world" || m.Get(m.Descriptor().Fields().ByName("id")).Int() != 42 {
+		t.Error("unexpected dynamic message", rq)
+	}
+	if b, err = NewDynamicDataBuilder(types, Proto).Pack(rq); err != nil || len(b) == 0 {
+		t.Error("pack dynamic message failed", err)
+	}
+}
+
+func TestDbp(t *testing.T) {
+	p := NewDbp()
+	if b, err := p.Get("Application/JSON; charset=utf-8"); err != nil || b.Name() != Json {
+		t.Error("expect json by content-type alias, got", b, err)
+	}
+	if b := p.Provider("unknown"); b == nil || b.Name() != Proto {
+		t.Error("expect proto fallback, got", b)
+	}
+	p.SetFallback("")
+	if _, err := p.Get("unknown"); !errors.Is(err, ErrUnknownDataBuilder) {
+		t.Error("expect unknown data builder error, got", err)
+	}
+	if b, err := p.Negotiate("text/html, application/msgpack;q=0.5, application/cbor;q=0.8"); err != nil || b.Name() != Cbor {
+		t.Error("expect cbor negotiated, got", b, err)
+	}
+	if ct := p.ContentType(Msgpack); ct != "application/msgpack" {
+		t.Error("expect msgpack content-type, got", ct)
+	}
+	if names := p.Names(); len(names) != 6 {
+		t.Error("expect 6 builders, got", names)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.Register(Name(fmt.Sprint("custom", i)), NewJsonDataBuilder())
+			_ = p.Provider(Json)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDetector(t *testing.T) {
+	p := NewTcpProvider(nil, nil)
+	if _, _, _, _, err := p.Detect(nil); !errors.Is(err, ErrNeedMoreData) {
+		t.Error("expect need more data on empty package, got", err)
+	}
+	if name, _, _, _ := p.ParseByPackage(nil); name != "" {
+		t.Error("expect empty name on empty package, got", name)
+	}
+
+	d := p.Detector()
+	d.Add(MagicRule(Cbor, 200, 0xCAFE), RegexRule(Json, 150, 3, regexp.MustCompile(`^\s+\{`)))
+	if _, _, _, _, err := p.Detect([]byte{0xCA}); !errors.Is(err, ErrNeedMoreData) {
+		t.Error("expect need more data for magic rule, got", err)
+	}
+	if name, _, _, rest, err := p.Detect([]byte{0xCA, 0xFE, 1}); err != nil || name != Cbor || len(rest) != 3 {
+		t.Error("expect cbor by magic, got", name, err)
+	}
+	if name, _, _, _, _ := p.Detect([]byte("  {}")); name != Json {
+		t.Error("expect json by regex, got", name)
+	}
+	if name, _, _, rest, _ := p.Detect([]byte("m\x80\x81")); name != Msgpack || len(rest) != 2 {
+		t.Error("expect msgpack tag stripped, got", name, rest)
+	}
+
+	d.SetDefault("")
+	_, _, _, _, err := p.Detect([]byte{0x08, 0x01, 0x02})
+	var ne *NoMatchError
+	if !errors.As(err, &ne) || len(ne.Head) != 3 {
+		t.Error("expect no match error, got", err)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	b, err := MarshalNegotiation(Offer{Version: 2, Codecs: []Name{Msgpack, Json}, Framings: []string{FramingLength}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o Offer
+	if _, err = UnmarshalNegotiation(b[:3], &o); !errors.Is(err, ErrNeedMoreData) {
+		t.Error("expect need more data, got", err)
+	}
+	rest, err := UnmarshalNegotiation(append(b, '{'), &o)
+	if err != nil || o.Version != 2 || len(o.Codecs) != 2 || o.Codecs[0] != Msgpack || string(rest) != "{" {
+		t.Error("expect offer and rest, got", o, rest, err)
+	}
+	if _, err = UnmarshalNegotiation([]byte("{}"), &o); !errors.Is(err, ErrNotNegotiation) {
+		t.Error("expect not negotiation, got", err)
+	}
+	if err = (Answer{Error: "none"}).Err(); !errors.Is(err, ErrNegotiationFailed) {
+		t.Error("expect negotiation failed, got", err)
+	}
+}
+
+func TestVersionedPackageBuilder(t *testing.T) {
+	envelope := func() PkgBuilder {
+		return NewJsonPackageBuilder(func(p *PKG) DataPtr {
+			return &jsonEnvelope{Action: p.Action.Val(), Data: p.Data}
+		}, func(d DataPtr) *PKG {
+			e := d.(*jsonEnvelope)
+			return &PKG{Action: ActionId(e.Action), Data: e.Data}
+		})
+	}
+	// 版本 1 的 action 偏移 100
+	vb := NewVersionedPackageBuilder(2, envelope()).
+		Register(1, envelope()).
+		Upgrade(1, func(p *PKG) error { p.Action -= 100; return nil }).
+		Downgrade(2, func(p *PKG) error { p.Action += 100; return nil })
+	v1 := vb.Version(1)
+	p := &PKG{Action: 1, Data: []byte("hello")}
+	b, err := v1.Pack(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 1 || !bytes.Contains(b, []byte(`"action":101`)) || p.Action != 1 {
+		t.Error("expect version 1 package with action 101, got", string(b))
+	}
+	// 任一视图都可拆任一版本
+	for _, pb := range []PkgBuilder{vb, v1} {
+		p1, err := pb.Unpack(b)
+		if err != nil || p1.Action != 1 || string(p1.Data) != "hello" {
+			t.Error("expect upgraded package, got", p1, err)
+		}
+	}
+	if b, _ = vb.Pack(p); b[0] != 2 {
+		t.Error("expect version 2, got", b[0])
+	}
+	if _, err = vb.Unpack([]byte{3, '{', '}'}); !errors.Is(err, ErrUnknownVersion) {
+		t.Error("expect unknown version, got", err)
+	}
+	if _, err = vb.Version(3).Pack(p); !errors.Is(err, ErrUnknownVersion) {
+		t.Error("expect unknown version, got", err)
+	}
+}
+
+func TestDefaultPackageBuilders(t *testing.T) {
+	p := &PKG{Action: 7, Data: []byte("hello")}
+	p.SetMeta(MetaMessageId, "42")
+	p.SetMeta(MetaTenant, "t1")
+	for _, pgb := range []PkgBuilder{NewDefaultProtobufPackageBuilder(), NewDefaultJsonPackageBuilder()} {
+		b, err := pgb.Pack(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1, err := pgb.Unpack(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p1.Action != 7 || string(p1.Data) != "hello" || p1.GetMeta(MetaMessageId) != "42" || p1.GetMeta(MetaTenant) != "t1" {
+			t.Error("unexpected package", p1)
+		}
+	}
+	var e Envelope
+	b, _ := NewDefaultProtobufPackageBuilder().Pack(p)
+	if err := proto.Unmarshal(b, &e); err != nil || e.RequestId != "42" {
+		t.Error("expect request id in envelope, got", e.RequestId, err)
+	}
+	// 只有 request id 的信封
+	b, _ = proto.Marshal(&Envelope{Action: 1, RequestId: "9"})
+	if p1, err := NewDefaultProtobufPackageBuilder().Unpack(b); err != nil || p1.GetMeta(MetaMessageId) != "9" {
+		t.Error("expect message id from request id, got", p1, err)
+	}
+	// 类型错误时拆包报告 unpack 而不是 pack
+	_, err := NewProtobufPackageBuilder(func(*PKG) DataPtr { return &JsonEnvelope{} }, nil).Unpack(b)
+	var be *BuilderError
+	if !errors.As(err, &be) || be.Op != OpUnpack || !errors.Is(err, ErrNotAProtobufMessage) {
+		t.Error("expect unpack error, got", err)
+	}
+}
+
+func TestWssProvider_ProtobufTags(t *testing.T) {
+	p := NewWssProvider(nil, nil)
+	payloads := [][]byte{
+		protowire.AppendVarint(protowire.AppendTag(nil, 16, protowire.VarintType), 1),   // 0x80
+		protowire.AppendVarint(protowire.AppendTag(nil, 20, protowire.VarintType), 1),   // 0xa0
+		protowire.AppendFixed32(protowire.AppendTag(nil, 13, protowire.Fixed32Type), 1), // 0x6d 'm'
+		protowire.AppendVarint(protowire.AppendTag(nil, 27, protowire.VarintType), 1),   // 0xd8
+	}
+	for _, b := range payloads {
+		name, _, _, rest := p.ParseByPackage(b)
+		if name != Proto || len(rest) != len(b) {
+			t.Errorf("expect proto for head % x, got %s with %d bytes", b[:1], name, len(rest))
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 )
 
 var (
-	ErrNotAProtobufMessage = errors.New("data builder error: Data builder pack failed, not a proto.Message ")
+	ErrNotAProtobufMessage = errors.New("not a proto.Message")
 )
 
 type DataPtr interface{}
@@ -44,7 +44,7 @@ func (pb *protobufDataBuilder) Unpack(b []byte, p DataPtr) (err error) {
 		err = ErrNotAProtobufMessage
 	}
 
-	return
+	return NewBuilderError(DataBuilderKind, Proto, OpUnpack, err)
 }
 func (pb *protobufDataBuilder) Pack(p DataPtr) (b []byte, err error) {
 	if p == nil {
@@ -56,7 +56,7 @@ func (pb *protobufDataBuilder) Pack(p DataPtr) (b []byte, err error) {
 		err = ErrNotAProtobufMessage
 	}
 
-	return
+	return b, NewBuilderError(DataBuilderKind, Proto, OpPack, err)
 }
 
 type jsonDataBuilder struct {
@@ -73,11 +73,12 @@ func (pb *jsonDataBuilder) Unpack(b []byte, p DataPtr) (err error) {
 	if len(b) == 0 || p == nil {
 		return
 	}
-	return json.Unmarshal(b, p)
+	return NewBuilderError(DataBuilderKind, Json, OpUnpack, json.Unmarshal(b, p))
 }
 func (pb *jsonDataBuilder) Pack(p DataPtr) (b []byte, err error) {
 	if p == nil {
 		return
 	}
-	return json.Marshal(p)
+	b, err = json.Marshal(p)
+	return b, NewBuilderError(DataBuilderKind, Json, OpPack, err)
 }
@@ -1,32 +1,170 @@
 package codec
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownDataBuilder = errors.New("data builder provider error: unknown data builder")
+
 type DataBuilderProvider interface {
 	Provider(Name) DataBuilder
 }
 
+// Dbp 数据构建器提供者, 可并发使用
 type Dbp struct {
+	mu        sync.RWMutex
 	providers map[Name]DataBuilder
+	aliases   map[string]Name
+	types     map[Name]string
+	fallback  Name
 }
 
+// DefaultDataBuilderProvider 默认提供者, 未知名称回退到 Proto
 var DefaultDataBuilderProvider = NewDbp()
 
+// NewDbp 注册内置数据构建器和 content-type 别名, 未知名称回退到 Proto, 可通过 SetFallback 修改
 func NewDbp() *Dbp {
 	s := &Dbp{
 		providers: make(map[Name]DataBuilder),
+		aliases:   make(map[string]Name),
+		types:     make(map[Name]string),
+		fallback:  Proto,
 	}
-	s.Register(Json, NewJsonDataBuilder())
-	s.Register(Proto, NewProtobufDataBuilder())
+	s.Register(Json, NewJsonDataBuilder(), "application/json", "text/json")
+	s.Register(Proto, NewProtobufDataBuilder(), "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf")
+	s.Register(Msgpack, NewMsgpackDataBuilder(), "application/msgpack", "application/x-msgpack", "application/vnd.msgpack")
+	s.Register(Cbor, NewCborDataBuilder(), "application/cbor")
+	s.Register(ProtoJson, NewProtojsonDataBuilder(), "application/protobuf+json")
+	s.Register(ProtoText, NewPrototextDataBuilder(), "text/x-protobuf", "text/protobuf")
 	return s
 }
 
-func (p *Dbp) Register(name Name, b DataBuilder) {
+// Register 注册数据构建器, aliases 为别名, 第一个别名作为 ContentType
+func (p *Dbp) Register(name Name, b DataBuilder, aliases ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.providers[name] = b
+	for i, alias := range aliases {
+		p.aliases[normalizeAlias(alias)] = name
+		if i == 0 {
+			p.types[name] = alias
+		}
+	}
+}
+
+// Alias 为已注册或将注册的名称添加别名, 如 "application/json" -> Json
+func (p *Dbp) Alias(alias string, name Name) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aliases[normalizeAlias(alias)] = name
+	if _, ok := p.types[name]; !ok && strings.Contains(alias, "/") {
+		p.types[name] = alias
+	}
+}
+
+// SetFallback 设置未知名称时使用的构建器, 为空时未知名称返回 ErrUnknownDataBuilder
+func (p *Dbp) SetFallback(name Name) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fallback = name
+}
+
+// Get 按名称或别名获取构建器, 未找到时使用回退构建器, 没有回退时返回 ErrUnknownDataBuilder
+func (p *Dbp) Get(name Name) (DataBuilder, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if b, ok := p.lookup(name); ok {
+		return b, nil
+	}
+	if b, ok := p.providers[p.fallback]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownDataBuilder, name)
+}
+
+func (p *Dbp) lookup(name Name) (DataBuilder, bool) {
+	if b, ok := p.providers[name]; ok {
+		return b, true
+	}
+	if n, ok := p.aliases[normalizeAlias(string(name))]; ok {
+		b, ok := p.providers[n]
+		return b, ok
+	}
+	return nil, false
 }
 
+// Provider 实现 DataBuilderProvider, 未知名称且没有回退时返回 nil
 func (p *Dbp) Provider(name Name) DataBuilder {
-	if v, ok := p.providers[name]; ok {
-		return v
+	b, _ := p.Get(name)
+	return b
+}
+
+// Names 已注册的名称
+func (p *Dbp) Names() []Name {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]Name, 0, len(p.providers))
+	for name := range p.providers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// ContentType 名称对应的 content-type, 未设置时为空
+func (p *Dbp) ContentType(name Name) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.types[name]
+}
+
+// Negotiate 按 Accept 格式的列表(如 "application/msgpack;q=0.9, application/json")选择 q 值最高的已注册构建器,
+// 都不支持时返回 ErrUnknownDataBuilder, 不使用回退构建器
+func (p *Dbp) Negotiate(accept string) (DataBuilder, error) {
+	type candidate struct {
+		name Name
+		q    float64
 	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		alias := strings.TrimSpace(fields[0])
+		if alias == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{Name(alias), q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
 
-	return p.providers[Proto]
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, c := range candidates {
+		if b, ok := p.lookup(c.name); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownDataBuilder, accept)
+}
+
+// normalizeAlias 别名不区分大小写并忽略参数, 如 "Application/JSON; charset=utf-8" -> "application/json"
+func normalizeAlias(alias string) string {
+	if i := strings.IndexByte(alias, ';'); i >= 0 {
+		alias = alias[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(alias))
 }
@@ -0,0 +1,159 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// ErrNeedMoreData 数据不足以判断协议, 应等待更多数据后重试
+var ErrNeedMoreData = errors.New("detector error: need more data")
+
+// NoMatchError 没有匹配的协议且未设置默认协议
+type NoMatchError struct {
+	Head []byte // 包的前几个字节
+}
+
+func (e *NoMatchError) Error() string {
+	return fmt.Sprintf("detector error: no protocol matched, head=% x", e.Head)
+}
+
+// Matcher 判断包是否属于协议, skip 为需要去掉的标记字节数
+type Matcher func(pkg []byte) (ok bool, skip int)
+
+// Rule 协议识别规则, Priority 大的先匹配, 相同时按添加顺序, 包长度小于 MinLen 时等待更多数据
+type Rule struct {
+	Name     Name
+	Priority int
+	MinLen   int
+	Match    Matcher
+}
+
+// PrefixRule 以 prefix 开头, strip 为 true 时去掉前缀
+func PrefixRule(name Name, priority int, prefix []byte, strip bool) Rule {
+	return Rule{Name: name, Priority: priority, MinLen: len(prefix), Match: func(pkg []byte) (bool, int) {
+		if !bytes.HasPrefix(pkg, prefix) {
+			return false, 0
+		}
+		if strip {
+			return true, len(prefix)
+		}
+		return true, 0
+	}}
+}
+
+// MagicRule 以大端序的 magic number 开头, 不去掉
+func MagicRule(name Name, priority int, magic uint16) Rule {
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, magic)
+	return PrefixRule(name, priority, prefix, false)
+}
+
+// RegexRule 前 minLen 个字节之后的数据也参与匹配, 正则应以 ^ 开头
+func RegexRule(name Name, priority, minLen int, re *regexp.Regexp) Rule {
+	return Rule{Name: name, Priority: priority, MinLen: minLen, Match: func(pkg []byte) (bool, int) {
+		return re.Match(pkg), 0
+	}}
+}
+
+// FuncRule 自定义匹配
+func FuncRule(name Name, priority, minLen int, match func(pkg []byte) bool) Rule {
+	return Rule{Name: name, Priority: priority, MinLen: minLen, Match: func(pkg []byte) (bool, int) {
+		return match(pkg), 0
+	}}
+}
+
+// Detector 按规则识别首包的协议, 可并发使用
+type Detector struct {
+	mu       sync.RWMutex
+	rules    []Rule
+	fallback Name
+	minLen   int
+}
+
+// NewDetector 默认协议为空, 没有匹配时返回 *NoMatchError
+func NewDetector(rules ...Rule) *Detector {
+	d := &Detector{minLen: 1}
+	d.Add(rules...)
+	return d
+}
+
+// Add 添加规则
+func (d *Detector) Add(rules ...Rule) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = append(d.rules, rules...)
+	sort.SliceStable(d.rules, func(i, j int) bool { return d.rules[i].Priority > d.rules[j].Priority })
+}
+
+// SetDefault 没有规则匹配时使用的协议, 为空时返回 *NoMatchError
+func (d *Detector) SetDefault(name Name) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fallback = name
+}
+
+// SetMinLen 识别需要的最少字节数, 默认 1
+func (d *Detector) SetMinLen(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	d.minLen = n
+}
+
+// Detect 返回协议名称和去掉标记后的包, 数据不足时返回 ErrNeedMoreData
+func (d *Detector) Detect(pkg []byte) (Name, []byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(pkg) < d.minLen {
+		return "", pkg, ErrNeedMoreData
+	}
+	for _, r := range d.rules {
+		if len(pkg) < r.MinLen {
+			// 优先的规则无法判断时不降级到后面的规则
+			return "", pkg, ErrNeedMoreData
+		}
+		if ok, skip := r.Match(pkg); ok {
+			return r.Name, pkg[skip:], nil
+		}
+	}
+	if d.fallback != "" {
+		return d.fallback, pkg, nil
+	}
+	head := pkg
+	if len(head) > 8 {
+		head = head[:8]
+	}
+	return "", pkg, &NoMatchError{Head: append([]byte(nil), head...)}
+}
+
+// jsonRules 首字节 '{' 为 json, 标记字节 'j' json 会被去掉
+func jsonRules() []Rule {
+	return []Rule{
+		PrefixRule(Json, 100, []byte("{"), false),
+		PrefixRule(Json, 100, []byte("j"), true),
+	}
+}
+
+// BinaryTagRules 标记字节 'm' msgpack 'c' cbor 会被去掉. websocket 的 protobuf 包以字段 tag 开头, 可能与标记相同,
+// 确认不会收到 protobuf 时再添加到 WssProvider
+func BinaryTagRules(priority int) []Rule {
+	return []Rule{
+		PrefixRule(Msgpack, priority, []byte("m"), true),
+		PrefixRule(Cbor, priority, []byte("c"), true),
+	}
+}
+
+// MapRules msgpack map 和 cbor map 开头的包, 与字段号 16 以上的 protobuf tag 冲突, 确认不会收到 protobuf 时再添加
+func MapRules(priority int) []Rule {
+	return []Rule{
+		FuncRule(Msgpack, priority, 1, isMsgpackMap),
+		FuncRule(Cbor, priority, 1, isCborMap),
+	}
+}
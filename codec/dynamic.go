@@ -0,0 +1,224 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"os"
+)
+
+var ErrUnknownMessage = errors.New("descriptor error: unknown message")
+
+// DescriptorTypes 从 FileDescriptorSet 加载的消息类型, 生成 dynamicpb 消息, 加载后只读可并发使用
+type DescriptorTypes struct {
+	files *protoregistry.Files
+	types *protoregistry.Types
+}
+
+// NewDescriptorTypes 加载描述集, 文件需按依赖顺序排列(protoc --include_imports 的输出), 集合外的依赖从已编译的类型中查找
+func NewDescriptorTypes(set *descriptorpb.FileDescriptorSet) (*DescriptorTypes, error) {
+	t := &DescriptorTypes{
+		files: new(protoregistry.Files),
+		types: new(protoregistry.Types),
+	}
+	for _, fdp := range set.GetFile() {
+		fd, err := protodesc.NewFile(fdp, t)
+		if err != nil {
+			return nil, fmt.Errorf("descriptor error: load file %s failed, err=%w", fdp.GetName(), err)
+		}
+		if err = t.files.RegisterFile(fd); err != nil {
+			return nil, fmt.Errorf("descriptor error: register file %s failed, err=%w", fdp.GetName(), err)
+		}
+		if err = t.registerTypes(fd.Messages(), fd.Enums(), fd.Extensions()); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// LoadDescriptorSet 从二进制的 FileDescriptorSet 加载
+func LoadDescriptorSet(reader io.Reader) (*DescriptorTypes, error) {
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor error: load descriptor set failed, err=%w", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("descriptor error: load descriptor set failed, err=%w", err)
+	}
+	return NewDescriptorTypes(set)
+}
+
+// LoadDescriptorSetFile 从 protoc --descriptor_set_out 生成的文件加载
+func LoadDescriptorSetFile(path string) (*DescriptorTypes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor error: load descriptor set failed, err=%w", err)
+	}
+	defer f.Close()
+	return LoadDescriptorSet(f)
+}
+
+func (t *DescriptorTypes) registerTypes(messages protoreflect.MessageDescriptors, enums protoreflect.EnumDescriptors, extensions protoreflect.ExtensionDescriptors) error {
+	for i := 0; i < enums.Len(); i++ {
+		if err := t.types.RegisterEnum(dynamicpb.NewEnumType(enums.Get(i))); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < extensions.Len(); i++ {
+		if err := t.types.RegisterExtension(dynamicpb.NewExtensionType(extensions.Get(i))); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		if md.IsMapEntry() {
+			continue
+		}
+		if err := t.types.RegisterMessage(dynamicpb.NewMessageType(md)); err != nil {
+			return err
+		}
+		if err := t.registerTypes(md.Messages(), md.Enums(), md.Extensions()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindFileByPath 实现 protodesc.Resolver
+func (t *DescriptorTypes) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := t.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+// FindDescriptorByName 实现 protodesc.Resolver
+func (t *DescriptorTypes) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := t.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// FindMessageByName 实现 protoregistry.MessageTypeResolver, 用于解析 Any
+func (t *DescriptorTypes) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if mt, err := t.types.FindMessageByName(name); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByName(name)
+}
+
+// FindMessageByURL 实现 protoregistry.MessageTypeResolver
+func (t *DescriptorTypes) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if mt, err := t.types.FindMessageByURL(url); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByURL(url)
+}
+
+// FindExtensionByName 实现 protoregistry.ExtensionTypeResolver
+func (t *DescriptorTypes) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	if xt, err := t.types.FindExtensionByName(field); err == nil {
+		return xt, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+// FindExtensionByNumber 实现 protoregistry.ExtensionTypeResolver
+func (t *DescriptorTypes) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	if xt, err := t.types.FindExtensionByNumber(message, field); err == nil {
+		return xt, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+// Message 按全名查找描述集中的消息
+func (t *DescriptorTypes) Message(name protoreflect.FullName) (protoreflect.MessageDescriptor, error) {
+	d, err := t.files.FindDescriptorByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMessage, name)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a message", ErrUnknownMessage, name)
+	}
+	return md, nil
+}
+
+// Structure 返回生成 name 对应 dynamicpb 消息的数据结构, name 为空返回 nil
+func (t *DescriptorTypes) Structure(name protoreflect.FullName) (func() DataPtr, error) {
+	if name == "" {
+		return nil, nil
+	}
+	md, err := t.Message(name)
+	if err != nil {
+		return nil, err
+	}
+	return func() DataPtr {
+		return dynamicpb.NewMessage(md)
+	}, nil
+}
+
+type dynamicDataBuilder struct {
+	name  Name
+	types *DescriptorTypes
+}
+
+// NewDynamicDataBuilder 以描述集解析 Any 和扩展的 protobuf 数据构建器, name 为 Proto ProtoJson 或 ProtoText, 数据结构可为 dynamicpb 消息或生成的消息
+func NewDynamicDataBuilder(types *DescriptorTypes, name Name) DataBuilder {
+	if name != ProtoJson && name != ProtoText {
+		name = Proto
+	}
+	return &dynamicDataBuilder{name: name, types: types}
+}
+
+func (pb *dynamicDataBuilder) Name() Name {
+	return pb.name
+}
+func (pb *dynamicDataBuilder) Unpack(b []byte, p DataPtr) (err error) {
+	if len(b) == 0 || p == nil {
+		return
+	}
+	m, ok := p.(proto.Message)
+	if !ok {
+		return NewBuilderError(DataBuilderKind, pb.name, OpUnpack, ErrNotAProtobufMessage)
+	}
+	switch pb.name {
+	case ProtoJson:
+		err = protojson.UnmarshalOptions{Resolver: pb.types}.Unmarshal(b, m)
+	case ProtoText:
+		err = prototext.UnmarshalOptions{Resolver: pb.types}.Unmarshal(b, m)
+	default:
+		err = proto.UnmarshalOptions{Resolver: pb.types}.Unmarshal(b, m)
+	}
+
+	return NewBuilderError(DataBuilderKind, pb.name, OpUnpack, err)
+}
+func (pb *dynamicDataBuilder) Pack(p DataPtr) (b []byte, err error) {
+	if p == nil {
+		return
+	}
+	m, ok := p.(proto.Message)
+	if !ok {
+		return nil, NewBuilderError(DataBuilderKind, pb.name, OpPack, ErrNotAProtobufMessage)
+	}
+	switch pb.name {
+	case ProtoJson:
+		b, err = protojson.MarshalOptions{Resolver: pb.types}.Marshal(m)
+	case ProtoText:
+		b, err = prototext.MarshalOptions{Resolver: pb.types}.Marshal(m)
+	default:
+		b, err = proto.Marshal(m)
+	}
+
+	return b, NewBuilderError(DataBuilderKind, pb.name, OpPack, err)
+}
@@ -0,0 +1,53 @@
+package codec
+
+//go:generate protoc --go_out=.. --go_opt=paths=source_relative -I.. codec/envelope.proto
+
+// JsonEnvelope 与 Envelope 对应的 json 信封, data 为 base64 字符串
+type JsonEnvelope struct {
+	Action    uint32 `json:"action"`
+	Data      []byte `json:"data,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+	Meta      Meta   `json:"meta,omitempty"`
+}
+
+// NewDefaultProtobufPackageBuilder 使用 Envelope 的 protobuf 包构建器, 无需转换函数
+func NewDefaultProtobufPackageBuilder() *ProtobufPackageBuilder {
+	return NewProtobufPackageBuilder(func(p *PKG) DataPtr {
+		return &Envelope{
+			Action:    p.Action.Val(),
+			Data:      p.Data,
+			RequestId: p.GetMeta(MetaMessageId),
+			Meta:      p.Meta.Clone(),
+		}
+	}, func(d DataPtr) *PKG {
+		e := d.(*Envelope)
+		return envelopePKG(e.Action, e.Data, e.RequestId, e.Meta)
+	})
+}
+
+// NewDefaultJsonPackageBuilder 使用 JsonEnvelope 的 json 包构建器, 无需转换函数
+func NewDefaultJsonPackageBuilder() *JsonPackageBuilder {
+	return NewJsonPackageBuilder(func(p *PKG) DataPtr {
+		return &JsonEnvelope{
+			Action:    p.Action.Val(),
+			Data:      p.Data,
+			RequestId: p.GetMeta(MetaMessageId),
+			Meta:      p.Meta.Clone(),
+		}
+	}, func(d DataPtr) *PKG {
+		e := d.(*JsonEnvelope)
+		return envelopePKG(e.Action, e.Data, e.RequestId, e.Meta)
+	})
+}
+
+// envelopePKG 信封转为包, 请求 id 写入元数据 message-id
+func envelopePKG(action uint32, data []byte, requestId string, meta Meta) *PKG {
+	p := &PKG{Action: ActionId(action), Data: data}
+	if len(meta) > 0 {
+		p.Meta = meta
+	}
+	if requestId != "" && p.GetMeta(MetaMessageId) == "" {
+		p.SetMeta(MetaMessageId, requestId)
+	}
+	return p
+}
@@ -0,0 +1,88 @@
+package codec
+
+import "errors"
+
+// 出错的操作
+const (
+	OpMarshal   = "marshal"   // Codec 封包
+	OpUnmarshal = "unmarshal" // Codec 拆包
+	OpPack      = "pack"      // 构建器封包
+	OpUnpack    = "unpack"    // 构建器拆包
+)
+
+// 构建器类型
+const (
+	PkgBuilderKind  = "pkg"
+	DataBuilderKind = "data"
+)
+
+// Temporary 可重试的错误
+type Temporary interface {
+	Temporary() bool
+}
+
+// IsTemporary 错误链中最外层实现 Temporary 的错误可重试时返回 true
+func IsTemporary(err error) bool {
+	var t Temporary
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// CodecError Codec 封包拆包错误, 数据本身有误, 不可重试
+type CodecError struct {
+	Op  string
+	Err error
+}
+
+// NewCodecError 包装 Codec 错误, err 已是 *CodecError 时原样返回
+func NewCodecError(op string, err error) error {
+	var e *CodecError
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	return &CodecError{Op: op, Err: err}
+}
+
+func (e *CodecError) Error() string {
+	return "codec error: " + e.Op + " failed, err=" + e.Err.Error()
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CodecError) Temporary() bool {
+	return false
+}
+
+// BuilderError 包构建器或数据构建器错误, 不可重试
+type BuilderError struct {
+	Kind string // PkgBuilderKind DataBuilderKind
+	Name Name   // 数据构建器名称
+	Op   string
+	Err  error
+}
+
+// NewBuilderError 包装构建器错误, err 已是同类的 *BuilderError 时原样返回
+func NewBuilderError(kind string, name Name, op string, err error) error {
+	var e *BuilderError
+	if err == nil || errors.As(err, &e) && e.Kind == kind {
+		return err
+	}
+	return &BuilderError{Kind: kind, Name: name, Op: op, Err: err}
+}
+
+func (e *BuilderError) Error() string {
+	s := e.Kind + " builder error: "
+	if e.Name != "" {
+		s += string(e.Name) + " "
+	}
+	return s + e.Op + " failed, err=" + e.Err.Error()
+}
+
+func (e *BuilderError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BuilderError) Temporary() bool {
+	return false
+}
@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 常用的元数据 key
+const (
+	MetaTraceParent   = "traceparent"
+	MetaTraceState    = "tracestate"
+	MetaTenant        = "tenant"
+	MetaAuthorization = "authorization"
+	MetaContentType   = "content-type"
+	MetaCompression   = "compression"
+	MetaMessageId     = "message-id"
+	MetaTimestamp     = "timestamp"
+)
+
+// Meta 包的元数据, 由 PkgBuilder 随网关包一起封包和拆包
+type Meta map[string]string
+
+func (m Meta) Get(key string) string {
+	return m[key]
+}
+
+// Set 设置元数据, m 不能为 nil
+func (m Meta) Set(key, value string) {
+	m[key] = value
+}
+
+// Keys 所有的 key
+func (m Meta) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (m Meta) Clone() Meta {
+	if m == nil {
+		return nil
+	}
+	m1 := make(Meta, len(m))
+	for k, v := range m {
+		m1[k] = v
+	}
+	return m1
+}
+
+// metaFieldNames 信封中承载元数据的 map<string, string> 字段名
+var metaFieldNames = []protoreflect.Name{"meta", "metadata"}
+
+func protoMetaField(m protoreflect.Message) protoreflect.FieldDescriptor {
+	fields := m.Descriptor().Fields()
+	for _, name := range metaFieldNames {
+		fd := fields.ByName(name)
+		if fd != nil && fd.IsMap() && fd.MapKey().Kind() == protoreflect.StringKind && fd.MapValue().Kind() == protoreflect.StringKind {
+			return fd
+		}
+	}
+	return nil
+}
+
+// setProtoMeta 信封有 meta 字段且转换函数未设置时写入元数据
+func setProtoMeta(msg proto.Message, meta Meta) {
+	if len(meta) == 0 {
+		return
+	}
+	m := msg.ProtoReflect()
+	fd := protoMetaField(m)
+	if fd == nil || m.Has(fd) {
+		return
+	}
+	mp := m.Mutable(fd).Map()
+	for k, v := range meta {
+		mp.Set(protoreflect.ValueOfString(k).MapKey(), protoreflect.ValueOfString(v))
+	}
+}
+
+func getProtoMeta(msg proto.Message) Meta {
+	m := msg.ProtoReflect()
+	fd := protoMetaField(m)
+	if fd == nil || !m.Has(fd) {
+		return nil
+	}
+	meta := make(Meta)
+	m.Get(fd).Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		meta[k.String()] = v.String()
+		return true
+	})
+	return meta
+}
+
+type jsonMeta struct {
+	Meta Meta `json:"meta,omitempty"`
+}
+
+// setJsonMeta 信封 json 中没有 meta 字段时加入元数据
+func setJsonMeta(b []byte, meta Meta) ([]byte, error) {
+	if len(meta) == 0 || len(b) < 2 || b[0] != '{' {
+		return b, nil
+	}
+	var exists jsonMeta
+	if err := json.Unmarshal(b, &exists); err != nil || exists.Meta != nil {
+		return b, err
+	}
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)+len(mb)+10))
+	buf.WriteString(`{"meta":`)
+	buf.Write(mb)
+	if rest := bytes.TrimSpace(b[1:]); len(rest) > 0 && rest[0] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(b[1:])
+
+	return buf.Bytes(), nil
+}
+
+func getJsonMeta(b []byte) Meta {
+	var m jsonMeta
+	_ = json.Unmarshal(b, &m)
+	return m.Meta
+}
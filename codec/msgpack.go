@@ -0,0 +1,21 @@
+package codec
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var msgpackFormat = newBinaryFormat[msgpack.RawMessage](Msgpack, msgpack.Marshal, msgpack.Unmarshal, isMsgpackMap)
+
+func NewMsgpackDataBuilder() DataBuilder {
+	return &binaryDataBuilder{format: msgpackFormat}
+}
+
+// NewMsgpackPackageBuilder MessagePack 包构建器
+func NewMsgpackPackageBuilder(toData func(*PKG) DataPtr, toPKG func(DataPtr) *PKG) *BinaryPackageBuilder {
+	return &BinaryPackageBuilder{format: msgpackFormat, gen: toData, to: toPKG}
+}
+
+// isMsgpackMap fixmap 0x80-0x8f, map16 0xde, map32 0xdf
+func isMsgpackMap(b []byte) bool {
+	return len(b) > 0 && (b[0]&0xf0 == 0x80 || b[0] == 0xde || b[0] == 0xdf)
+}
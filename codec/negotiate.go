@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// NegotiationTag 协商消息的首字节, 消息格式为 tag + 4 字节大端长度 + json
+const NegotiationTag byte = 'n'
+
+// 分帧 codec 名称
+const (
+	FramingDelimiter = "delimiter"
+	FramingLength    = "length"
+	FramingWebsocket = "websocket"
+)
+
+var (
+	ErrNotNegotiation    = errors.New("negotiation error: not a negotiation message")
+	ErrNegotiationFailed = errors.New("negotiation error: no acceptable protocol")
+)
+
+// Offer 客户端在连接开始时的提议, 列表按优先级排列
+type Offer struct {
+	Version      int      `json:"version"`
+	Codecs       []Name   `json:"codecs,omitempty"`
+	Framings     []string `json:"framings,omitempty"`
+	Interceptors []string `json:"interceptors,omitempty"`
+}
+
+// Answer 对端的选择, 为空的项表示保持默认
+type Answer struct {
+	Version      int      `json:"version"`
+	Codec        Name     `json:"codec,omitempty"`
+	Framing      string   `json:"framing,omitempty"`
+	Interceptors []string `json:"interceptors,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Err 对端拒绝时返回错误
+func (a Answer) Err() error {
+	if a.Error == "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNegotiationFailed, a.Error)
+}
+
+// MarshalNegotiation 编码 Offer 或 Answer
+func MarshalNegotiation(v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 5+len(body))
+	b[0] = NegotiationTag
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(body)))
+	copy(b[5:], body)
+	return b, nil
+}
+
+// UnmarshalNegotiation 解码一条协商消息并返回剩余数据, 数据不足返回 ErrNeedMoreData, 不是协商消息返回 ErrNotNegotiation
+func UnmarshalNegotiation(b []byte, v interface{}) ([]byte, error) {
+	if len(b) == 0 {
+		return b, ErrNeedMoreData
+	}
+	if b[0] != NegotiationTag {
+		return b, ErrNotNegotiation
+	}
+	if len(b) < 5 {
+		return b, ErrNeedMoreData
+	}
+	n := int(binary.BigEndian.Uint32(b[1:5]))
+	if len(b) < 5+n {
+		return b, ErrNeedMoreData
+	}
+	if err := json.Unmarshal(b[5:5+n], v); err != nil {
+		return b, fmt.Errorf("%w: %s", ErrNotNegotiation, err.Error())
+	}
+	return b[5+n:], nil
+}
@@ -7,21 +7,35 @@ import (
 )
 
 var (
-	ErrNoData  = errors.New("pkg builder error: Unpack package failed, err= no data. ")
-	ErrDataNil = errors.New("pkg builder error: pack package failed, err= data is nil. ")
+	ErrNoData  = errors.New("no data")
+	ErrDataNil = errors.New("data is nil")
 )
 
 func packErr(err error) error {
-	return errors.New("pkg builder error: Pack package failed, err=" + err.Error())
+	return &BuilderError{Kind: PkgBuilderKind, Op: OpPack, Err: err}
 }
 
 func unpackErr(err error) error {
-	return errors.New("pkg builder error: Unpack package failed, err=" + err.Error())
+	return &BuilderError{Kind: PkgBuilderKind, Op: OpUnpack, Err: err}
 }
 
 type PKG struct {
 	Action ActionId
 	Data   []byte
+	Meta   Meta
+}
+
+// GetMeta 返回元数据
+func (p *PKG) GetMeta(key string) string {
+	return p.Meta.Get(key)
+}
+
+// SetMeta 设置元数据
+func (p *PKG) SetMeta(key, value string) {
+	if p.Meta == nil {
+		p.Meta = make(Meta)
+	}
+	p.Meta[key] = value
 }
 
 // PkgBuilder 包构建器
@@ -44,12 +58,12 @@ func NewProtobufPackageBuilder(toData func(*PKG) DataPtr, toPKG func(DataPtr) *P
 // Unpack 拆包
 func (pp *ProtobufPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
 	if len(b) == 0 {
-		err = ErrNoData
+		err = unpackErr(ErrNoData)
 		return
 	}
 	p1 := pp.gen(&PKG{})
 	if p2, ok := p1.(proto.Message); !ok {
-		err = packErr(errors.New("not proto message"))
+		err = unpackErr(ErrNotAProtobufMessage)
 		return
 	} else {
 		if err = proto.Unmarshal(b, p2); err != nil {
@@ -57,6 +71,9 @@ func (pp *ProtobufPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
 		}
 	}
 	p = pp.to(p1)
+	if p != nil && len(p.Meta) == 0 {
+		p.Meta = getProtoMeta(p1.(proto.Message))
+	}
 
 	return
 }
@@ -64,14 +81,15 @@ func (pp *ProtobufPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
 // Pack 封包
 func (pp *ProtobufPackageBuilder) Pack(p *PKG) (b []byte, err error) {
 	if p == nil {
-		err = ErrDataNil
+		err = packErr(ErrDataNil)
 		return
 	}
 	p2 := pp.gen(p)
 	if p1, ok := p2.(proto.Message); !ok {
-		err = packErr(errors.New("not proto message"))
+		err = packErr(ErrNotAProtobufMessage)
 		return
 	} else {
+		setProtoMeta(p1, p.Meta)
 		if b, err = proto.Marshal(p1); err != nil {
 			err = packErr(err)
 		}
@@ -96,7 +114,7 @@ func (pp *JsonPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
 	}
 	p1 := pp.gen(&PKG{})
 	if p1 == nil {
-		err = unpackErr(errors.New("unpack to data is nil"))
+		err = unpackErr(ErrDataNil)
 		return
 	}
 	if err = json.Unmarshal(b, p1); err != nil {
@@ -104,6 +122,9 @@ func (pp *JsonPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
 	}
 
 	p = pp.to(p1)
+	if p != nil && len(p.Meta) == 0 {
+		p.Meta = getJsonMeta(b)
+	}
 
 	return
 }
@@ -111,16 +132,20 @@ func (pp *JsonPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
 // Pack 封包
 func (pp *JsonPackageBuilder) Pack(p *PKG) (b []byte, err error) {
 	if p == nil {
-		err = ErrDataNil
+		err = packErr(ErrDataNil)
 		return
 	}
 	p1 := pp.gen(p)
 	if p1 == nil {
-		err = unpackErr(errors.New("pack to data is nil"))
+		err = packErr(ErrDataNil)
 		return
 	}
 	if b, err = json.Marshal(p1); err != nil {
 		err = packErr(err)
+		return
+	}
+	if b, err = setJsonMeta(b, p.Meta); err != nil {
+		err = packErr(err)
 	}
 
 	return
@@ -0,0 +1,160 @@
+package codec
+
+import (
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtojsonOption protojson 和 prototext 构建器选项
+type ProtojsonOption func(*protojsonOptions)
+
+type protojsonOptions struct {
+	emitUnpopulated bool
+	useProtoNames   bool
+	discardUnknown  bool
+}
+
+// EmitUnpopulated 输出未赋值的字段, 仅 protojson
+func EmitUnpopulated() ProtojsonOption {
+	return func(o *protojsonOptions) {
+		o.emitUnpopulated = true
+	}
+}
+
+// UseProtoNames 使用 proto 中的字段名而不是 lowerCamelCase, 仅 protojson
+func UseProtoNames() ProtojsonOption {
+	return func(o *protojsonOptions) {
+		o.useProtoNames = true
+	}
+}
+
+// DiscardUnknown 解码时忽略未知字段
+func DiscardUnknown() ProtojsonOption {
+	return func(o *protojsonOptions) {
+		o.discardUnknown = true
+	}
+}
+
+func newProtojsonOptions(options []ProtojsonOption) *protojsonOptions {
+	o := &protojsonOptions{}
+	for _, opt := range options {
+		opt(o)
+	}
+	return o
+}
+
+func (o *protojsonOptions) marshal(name Name, m proto.Message) ([]byte, error) {
+	if name == ProtoText {
+		return prototext.Marshal(m)
+	}
+	return protojson.MarshalOptions{EmitUnpopulated: o.emitUnpopulated, UseProtoNames: o.useProtoNames}.Marshal(m)
+}
+
+func (o *protojsonOptions) unmarshal(name Name, b []byte, m proto.Message) error {
+	if name == ProtoText {
+		return prototext.UnmarshalOptions{DiscardUnknown: o.discardUnknown}.Unmarshal(b, m)
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: o.discardUnknown}.Unmarshal(b, m)
+}
+
+type protojsonDataBuilder struct {
+	name    Name
+	options *protojsonOptions
+}
+
+// NewProtojsonDataBuilder protobuf 消息的 json 数据构建器, 正确处理 oneof、枚举、well-known 类型和 int64
+func NewProtojsonDataBuilder(options ...ProtojsonOption) DataBuilder {
+	return &protojsonDataBuilder{name: ProtoJson, options: newProtojsonOptions(options)}
+}
+
+// NewPrototextDataBuilder protobuf 消息的文本格式数据构建器
+func NewPrototextDataBuilder(options ...ProtojsonOption) DataBuilder {
+	return &protojsonDataBuilder{name: ProtoText, options: newProtojsonOptions(options)}
+}
+
+func (pb *protojsonDataBuilder) Name() Name {
+	return pb.name
+}
+func (pb *protojsonDataBuilder) Unpack(b []byte, p DataPtr) (err error) {
+	if len(b) == 0 || p == nil {
+		return
+	}
+	if m, ok := p.(proto.Message); ok {
+		err = pb.options.unmarshal(pb.name, b, m)
+	} else {
+		err = ErrNotAProtobufMessage
+	}
+
+	return NewBuilderError(DataBuilderKind, pb.name, OpUnpack, err)
+}
+func (pb *protojsonDataBuilder) Pack(p DataPtr) (b []byte, err error) {
+	if p == nil {
+		return
+	}
+	if m, ok := p.(proto.Message); ok {
+		b, err = pb.options.marshal(pb.name, m)
+	} else {
+		err = ErrNotAProtobufMessage
+	}
+
+	return b, NewBuilderError(DataBuilderKind, pb.name, OpPack, err)
+}
+
+// ProtojsonPackageBuilder protobuf 包消息以 protojson 或 prototext 编码的包构建器
+type ProtojsonPackageBuilder struct {
+	name    Name
+	options *protojsonOptions
+	gen     func(*PKG) DataPtr
+	to      func(DataPtr) *PKG
+}
+
+func NewProtojsonPackageBuilder(toData func(*PKG) DataPtr, toPKG func(DataPtr) *PKG, options ...ProtojsonOption) *ProtojsonPackageBuilder {
+	return &ProtojsonPackageBuilder{name: ProtoJson, options: newProtojsonOptions(options), gen: toData, to: toPKG}
+}
+
+func NewPrototextPackageBuilder(toData func(*PKG) DataPtr, toPKG func(DataPtr) *PKG, options ...ProtojsonOption) *ProtojsonPackageBuilder {
+	return &ProtojsonPackageBuilder{name: ProtoText, options: newProtojsonOptions(options), gen: toData, to: toPKG}
+}
+
+// Unpack 拆包
+func (pp *ProtojsonPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
+	if len(b) == 0 {
+		err = unpackErr(ErrNoData)
+		return
+	}
+	p1, ok := pp.gen(&PKG{}).(proto.Message)
+	if !ok {
+		err = unpackErr(ErrNotAProtobufMessage)
+		return
+	}
+	if err = pp.options.unmarshal(pp.name, b, p1); err != nil {
+		err = unpackErr(err)
+		return
+	}
+	p = pp.to(p1)
+	if p != nil && len(p.Meta) == 0 {
+		p.Meta = getProtoMeta(p1)
+	}
+
+	return
+}
+
+// Pack 封包
+func (pp *ProtojsonPackageBuilder) Pack(p *PKG) (b []byte, err error) {
+	if p == nil {
+		err = packErr(ErrDataNil)
+		return
+	}
+	p1, ok := pp.gen(p).(proto.Message)
+	if !ok {
+		err = packErr(ErrNotAProtobufMessage)
+		return
+	}
+	setProtoMeta(p1, p.Meta)
+	if b, err = pp.options.marshal(pp.name, p1); err != nil {
+		err = packErr(err)
+	}
+
+	return
+}
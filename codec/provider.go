@@ -1,8 +1,12 @@
 package codec
 
 const (
-	Proto Name = "proto"
-	Json  Name = "json"
+	Proto     Name = "proto"
+	Json      Name = "json"
+	Msgpack   Name = "msgpack"
+	Cbor      Name = "cbor"
+	ProtoJson Name = "protojson" // protobuf 消息的 protojson 编码
+	ProtoText Name = "prototext" // protobuf 消息的文本编码
 )
 
 type Name string
@@ -16,16 +20,31 @@ type Provider interface {
 	GetByName(name Name) (Name, Codec, PkgBuilder)
 }
 
+// DetectProvider 可返回识别错误的提供者
+type DetectProvider interface {
+	Provider
+	Detect(firstPkg []byte) (Name, Codec, PkgBuilder, []byte, error)
+}
+
 type TcpProvider struct {
 	toData    func(p *PKG) DataPtr
 	toPKG     func(d DataPtr) *PKG
 	delimiter []byte
 	magicNum  uint16
 	bodyMax   int
+	detector  *Detector
 }
 
 func NewTcpProvider(toData func(p *PKG) DataPtr, toPKG func(d DataPtr) *PKG) *TcpProvider {
-	return &TcpProvider{toData: toData, toPKG: toPKG, delimiter: []byte("\\N\\B"), magicNum: 0xAB}
+	// tcp 的 protobuf 包以 magic number 开头, 不会与标记字节冲突
+	detector := NewDetector(append(jsonRules(), BinaryTagRules(100)...)...)
+	detector.SetDefault(Proto)
+	return &TcpProvider{toData: toData, toPKG: toPKG, delimiter: []byte("\\N\\B"), magicNum: 0xAB, detector: detector}
+}
+
+// Detector 首包识别规则, 可添加规则或修改默认协议
+func (s *TcpProvider) Detector() *Detector {
+	return s.detector
 }
 
 func (s *TcpProvider) SetDelimiter(delimiter []byte) {
@@ -40,21 +59,31 @@ func (s *TcpProvider) SetBodyMax(bodyMax int) {
 	s.bodyMax = bodyMax
 }
 
+// ParseByPackage 默认规则: 首字节 '{' 为 json, 标记字节 'j' json 'm' msgpack 'c' cbor 会被去掉, 其他为 proto,
+// 识别失败时返回空名称, 需要错误信息时使用 Detect
 func (s *TcpProvider) ParseByPackage(firstPkg []byte) (Name, Codec, PkgBuilder, []byte) {
-	tag := firstPkg[0]
-	if tag == byte('{') {
-		return Json, NewDelimiterCodec(s.delimiter, s.delimiter), NewJsonPackageBuilder(s.toData, s.toPKG), firstPkg
-	}
-	if tag == byte('j') {
-		return Json, NewDelimiterCodec(s.delimiter, s.delimiter), NewJsonPackageBuilder(s.toData, s.toPKG), firstPkg[1:]
-	}
+	name, cdc, pgb, pkg, _ := s.Detect(firstPkg)
+	return name, cdc, pgb, pkg
+}
 
-	return Proto, NewLengthCodec(s.magicNum, s.bodyMax), NewProtobufPackageBuilder(s.toData, s.toPKG), firstPkg
+// Detect 按规则识别首包, 数据不足返回 ErrNeedMoreData, 无匹配返回 *NoMatchError
+func (s *TcpProvider) Detect(firstPkg []byte) (Name, Codec, PkgBuilder, []byte, error) {
+	name, pkg, err := s.detector.Detect(firstPkg)
+	if err != nil {
+		return "", nil, nil, firstPkg, err
+	}
+	name, cdc, pgb := s.GetByName(name)
+	return name, cdc, pgb, pkg, nil
 }
 
 func (s *TcpProvider) GetByName(name Name) (Name, Codec, PkgBuilder) {
-	if name == Json {
+	switch name {
+	case Json:
 		return Json, NewDelimiterCodec(s.delimiter, s.delimiter), NewJsonPackageBuilder(s.toData, s.toPKG)
+	case Msgpack:
+		return Msgpack, NewLengthCodec(s.magicNum, s.bodyMax), NewMsgpackPackageBuilder(s.toData, s.toPKG)
+	case Cbor:
+		return Cbor, NewLengthCodec(s.magicNum, s.bodyMax), NewCborPackageBuilder(s.toData, s.toPKG)
 	}
 	return Proto, NewLengthCodec(s.magicNum, s.bodyMax), NewProtobufPackageBuilder(s.toData, s.toPKG)
 }
@@ -64,29 +93,47 @@ func TcpDefaultProvider(toData func(p *PKG) DataPtr, toPKG func(d DataPtr) *PKG)
 }
 
 type WssProvider struct {
-	toData func(p *PKG) DataPtr
-	toPKG  func(d DataPtr) *PKG
+	toData   func(p *PKG) DataPtr
+	toPKG    func(d DataPtr) *PKG
+	detector *Detector
 }
 
 func NewWssProvider(toData func(p *PKG) DataPtr, toPKG func(d DataPtr) *PKG) *WssProvider {
-	return &WssProvider{toData, toPKG}
+	detector := NewDetector(jsonRules()...)
+	detector.SetDefault(Proto)
+	return &WssProvider{toData: toData, toPKG: toPKG, detector: detector}
+}
+
+// Detector 首包识别规则, 可添加规则或修改默认协议
+func (s *WssProvider) Detector() *Detector {
+	return s.detector
 }
 
+// ParseByPackage 默认规则: 首字节 '{' 为 json, 标记字节 'j' json 会被去掉, 其他为 proto,
+// msgpack cbor 需通过 Detector 添加 BinaryTagRules 或 MapRules
 func (s *WssProvider) ParseByPackage(firstPkg []byte) (Name, Codec, PkgBuilder, []byte) {
-	tag := firstPkg[0]
-	if tag == byte('{') {
-		return Json, NewWebsocketCodec(), NewJsonPackageBuilder(s.toData, s.toPKG), firstPkg
-	}
-	if tag == byte('j') {
-		return Json, NewWebsocketCodec(), NewJsonPackageBuilder(s.toData, s.toPKG), firstPkg[1:]
-	}
+	name, cdc, pgb, pkg, _ := s.Detect(firstPkg)
+	return name, cdc, pgb, pkg
+}
 
-	return Proto, NewWebsocketCodec(), NewProtobufPackageBuilder(s.toData, s.toPKG), firstPkg
+// Detect 按规则识别首包, 数据不足返回 ErrNeedMoreData, 无匹配返回 *NoMatchError
+func (s *WssProvider) Detect(firstPkg []byte) (Name, Codec, PkgBuilder, []byte, error) {
+	name, pkg, err := s.detector.Detect(firstPkg)
+	if err != nil {
+		return "", nil, nil, firstPkg, err
+	}
+	name, cdc, pgb := s.GetByName(name)
+	return name, cdc, pgb, pkg, nil
 }
 
 func (s *WssProvider) GetByName(name Name) (Name, Codec, PkgBuilder) {
-	if name == Json {
+	switch name {
+	case Json:
 		return Json, NewWebsocketCodec(), NewJsonPackageBuilder(s.toData, s.toPKG)
+	case Msgpack:
+		return Msgpack, NewWebsocketCodec(), NewMsgpackPackageBuilder(s.toData, s.toPKG)
+	case Cbor:
+		return Cbor, NewWebsocketCodec(), NewCborPackageBuilder(s.toData, s.toPKG)
 	}
 	return Proto, NewWebsocketCodec(), NewProtobufPackageBuilder(s.toData, s.toPKG)
 }
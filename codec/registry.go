@@ -0,0 +1,202 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrDuplicateAction = errors.New("action registry error: duplicate action")
+	ErrUnknownAction   = errors.New("action registry error: unknown action")
+)
+
+// ActionDefinition action 的定义, Request Response 提供请求和回复的数据结构, 可为空
+type ActionDefinition struct {
+	Action   Action
+	Request  func() DataPtr
+	Response func() DataPtr
+}
+
+// ActionRegistry action 注册表, 可并发使用
+type ActionRegistry struct {
+	mu          sync.RWMutex
+	byId        map[ActionId]ActionDefinition
+	byName      map[string]ActionId
+	descriptors *DescriptorTypes
+}
+
+func NewActionRegistry() *ActionRegistry {
+	return &ActionRegistry{
+		byId:   make(map[ActionId]ActionDefinition),
+		byName: make(map[string]ActionId),
+	}
+}
+
+// Register 注册 action, id 或名称重复时返回 ErrDuplicateAction
+func (r *ActionRegistry) Register(def ActionDefinition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.byId[def.Action.Id]; ok {
+		return fmt.Errorf("%w: id %s registered as %s", ErrDuplicateAction, def.Action.Id, d.Action)
+	}
+	if def.Action.Name != "" {
+		if id, ok := r.byName[def.Action.Name]; ok {
+			return fmt.Errorf("%w: name %s registered as %s", ErrDuplicateAction, def.Action.Name, r.byId[id].Action)
+		}
+		r.byName[def.Action.Name] = def.Action.Id
+	}
+	r.byId[def.Action.Id] = def
+
+	return nil
+}
+
+// MustRegister 注册 action, 失败 panic
+func (r *ActionRegistry) MustRegister(defs ...ActionDefinition) {
+	for _, def := range defs {
+		if err := r.Register(def); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Bind 为已注册的 action 设置请求和回复的数据结构
+func (r *ActionRegistry) Bind(id ActionId, request, response func() DataPtr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	def, ok := r.byId[id]
+	if !ok {
+		return fmt.Errorf("%w: id %s", ErrUnknownAction, id)
+	}
+	def.Request, def.Response = request, response
+	r.byId[id] = def
+
+	return nil
+}
+
+// Lookup 按 id 查找
+func (r *ActionRegistry) Lookup(id ActionId) (ActionDefinition, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	def, ok := r.byId[id]
+	return def, ok
+}
+
+// LookupName 按名称查找
+func (r *ActionRegistry) LookupName(name string) (ActionDefinition, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.byName[name]
+	if !ok {
+		return ActionDefinition{}, false
+	}
+	return r.byId[id], true
+}
+
+// Action 返回 id 对应的 action, 未注册时名称为空
+func (r *ActionRegistry) Action(id ActionId) Action {
+	if def, ok := r.Lookup(id); ok {
+		return def.Action
+	}
+	return NewAction(id, "")
+}
+
+// Actions 已注册的 action, 按 id 排序
+func (r *ActionRegistry) Actions() []Action {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	actions := make([]Action, 0, len(r.byId))
+	for _, def := range r.byId {
+		actions = append(actions, def.Action)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Id < actions[j].Id
+	})
+	return actions
+}
+
+// RegisterEnum 以 protobuf 枚举的值为 id, 值名称为 action 名称注册, 忽略 0 值
+func (r *ActionRegistry) RegisterEnum(ed protoreflect.EnumDescriptor) error {
+	values := ed.Values()
+	for i := 0; i < values.Len(); i++ {
+		v := values.Get(i)
+		if v.Number() <= 0 {
+			continue
+		}
+		if err := r.Register(ActionDefinition{Action: NewAction(ActionId(v.Number()), string(v.Name()))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseDescriptors 设置描述集, 目录中的 request response 消息名从中查找
+func (r *ActionRegistry) UseDescriptors(types *DescriptorTypes) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.descriptors = types
+}
+
+// RegisterMessages 注册 action, 请求和回复为描述集中的消息, 名称为空表示无数据
+func (r *ActionRegistry) RegisterMessages(types *DescriptorTypes, action Action, request, response protoreflect.FullName) error {
+	def := ActionDefinition{Action: action}
+	var err error
+	if def.Request, err = types.Structure(request); err != nil {
+		return err
+	}
+	if def.Response, err = types.Structure(response); err != nil {
+		return err
+	}
+	return r.Register(def)
+}
+
+// catalogItem 目录文件中的 action
+type catalogItem struct {
+	Id       ActionId `yaml:"id" json:"id"`
+	Name     string   `yaml:"name" json:"name"`
+	Request  string   `yaml:"request" json:"request"`
+	Response string   `yaml:"response" json:"response"`
+}
+
+// LoadCatalog 从 YAML 或 JSON 目录注册 action, 格式为 [{id: 1, name: hello, request: pkg.HelloRequest, response: pkg.HelloResponse}, ...],
+// request response 可省略, 设置时需先调用 UseDescriptors
+func (r *ActionRegistry) LoadCatalog(reader io.Reader) error {
+	var items []catalogItem
+	if err := yaml.NewDecoder(reader).Decode(&items); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("action registry error: load catalog failed, err=%w", err)
+	}
+	r.mu.RLock()
+	types := r.descriptors
+	r.mu.RUnlock()
+	for _, item := range items {
+		action := NewAction(item.Id, item.Name)
+		if item.Request == "" && item.Response == "" {
+			if err := r.Register(ActionDefinition{Action: action}); err != nil {
+				return err
+			}
+			continue
+		}
+		if types == nil {
+			return fmt.Errorf("%w: %s, no descriptors", ErrUnknownMessage, item.Name)
+		}
+		if err := r.RegisterMessages(types, action, protoreflect.FullName(item.Request), protoreflect.FullName(item.Response)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadCatalogFile 从 YAML 或 JSON 目录文件注册 action
+func (r *ActionRegistry) LoadCatalogFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("action registry error: load catalog failed, err=%w", err)
+	}
+	defer f.Close()
+	return r.LoadCatalog(f)
+}
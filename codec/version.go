@@ -0,0 +1,178 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownVersion = errors.New("version error: unknown package version")
+
+// PkgVersion 包版本, 写在包的第一个字节
+type PkgVersion uint8
+
+// Migration 在相邻版本之间转换包, 应替换 Data 而不是修改其内容
+type Migration func(p *PKG) error
+
+// versionSet 各版本的构建器和转换, 同一个 VersionedPackageBuilder 的各个版本视图共享
+type versionSet struct {
+	mu         sync.RWMutex
+	builders   map[PkgVersion]PkgBuilder
+	upgrades   map[PkgVersion]Migration
+	downgrades map[PkgVersion]Migration
+}
+
+// VersionedPackageBuilder 版本化的包构建器, 包格式为 1 字节版本 + 该版本构建器的包,
+// 拆包后从包的版本逐级升级到最新版本, 封包前从最新版本逐级降级到固定的版本, 可并发使用
+type VersionedPackageBuilder struct {
+	set     *versionSet
+	version PkgVersion
+}
+
+// NewVersionedPackageBuilder 注册版本 version 的构建器并以该版本封包
+func NewVersionedPackageBuilder(version PkgVersion, builder PkgBuilder) *VersionedPackageBuilder {
+	vb := &VersionedPackageBuilder{
+		set: &versionSet{
+			builders:   make(map[PkgVersion]PkgBuilder),
+			upgrades:   make(map[PkgVersion]Migration),
+			downgrades: make(map[PkgVersion]Migration),
+		},
+		version: version,
+	}
+	vb.Register(version, builder)
+	return vb
+}
+
+// Register 注册版本的构建器, 所有版本视图可见
+func (vb *VersionedPackageBuilder) Register(version PkgVersion, builder PkgBuilder) *VersionedPackageBuilder {
+	vb.set.mu.Lock()
+	defer vb.set.mu.Unlock()
+	vb.set.builders[version] = builder
+	return vb
+}
+
+// Upgrade 从版本 from 升级到 from+1 的转换, 未设置时不转换
+func (vb *VersionedPackageBuilder) Upgrade(from PkgVersion, m Migration) *VersionedPackageBuilder {
+	vb.set.mu.Lock()
+	defer vb.set.mu.Unlock()
+	vb.set.upgrades[from] = m
+	return vb
+}
+
+// Downgrade 从版本 from 降级到 from-1 的转换, 未设置时不转换
+func (vb *VersionedPackageBuilder) Downgrade(from PkgVersion, m Migration) *VersionedPackageBuilder {
+	vb.set.mu.Lock()
+	defer vb.set.mu.Unlock()
+	vb.set.downgrades[from] = m
+	return vb
+}
+
+// Version 返回以 version 封包的视图, 与原构建器共享注册, 用于按连接固定版本
+func (vb *VersionedPackageBuilder) Version(version PkgVersion) *VersionedPackageBuilder {
+	return &VersionedPackageBuilder{set: vb.set, version: version}
+}
+
+// PackVersion 封包使用的版本
+func (vb *VersionedPackageBuilder) PackVersion() PkgVersion {
+	return vb.version
+}
+
+// Supports 是否注册了版本
+func (vb *VersionedPackageBuilder) Supports(version PkgVersion) bool {
+	vb.set.mu.RLock()
+	defer vb.set.mu.RUnlock()
+	_, ok := vb.set.builders[version]
+	return ok
+}
+
+// Versions 已注册的版本, 升序
+func (vb *VersionedPackageBuilder) Versions() []PkgVersion {
+	vb.set.mu.RLock()
+	defer vb.set.mu.RUnlock()
+	versions := make([]PkgVersion, 0, len(vb.set.builders))
+	for v := range vb.set.builders {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// Latest 已注册的最高版本, 应用层使用该版本的包结构
+func (vb *VersionedPackageBuilder) Latest() PkgVersion {
+	versions := vb.Versions()
+	return versions[len(versions)-1]
+}
+
+func (vb *VersionedPackageBuilder) builder(version PkgVersion) (PkgBuilder, error) {
+	vb.set.mu.RLock()
+	defer vb.set.mu.RUnlock()
+	b, ok := vb.set.builders[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+	return b, nil
+}
+
+// migrate 逐级转换 p 从版本 from 到 to
+func (vb *VersionedPackageBuilder) migrate(p *PKG, from, to PkgVersion) error {
+	vb.set.mu.RLock()
+	defer vb.set.mu.RUnlock()
+	for v := from; v < to; v++ {
+		if m := vb.set.upgrades[v]; m != nil {
+			if err := m(p); err != nil {
+				return fmt.Errorf("upgrade from version %d failed, err=%w", v, err)
+			}
+		}
+	}
+	for v := from; v > to; v-- {
+		if m := vb.set.downgrades[v]; m != nil {
+			if err := m(p); err != nil {
+				return fmt.Errorf("downgrade from version %d failed, err=%w", v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Unpack 按包的版本拆包并升级到最新版本
+func (vb *VersionedPackageBuilder) Unpack(b []byte) (p *PKG, err error) {
+	if len(b) == 0 {
+		return
+	}
+	version := PkgVersion(b[0])
+	builder, err := vb.builder(version)
+	if err != nil {
+		return nil, unpackErr(err)
+	}
+	if p, err = builder.Unpack(b[1:]); err != nil || p == nil {
+		return
+	}
+	if err = vb.migrate(p, version, vb.Latest()); err != nil {
+		return nil, unpackErr(err)
+	}
+	return
+}
+
+// Pack 从最新版本降级到固定的版本后封包, 不修改 p
+func (vb *VersionedPackageBuilder) Pack(p *PKG) (b []byte, err error) {
+	if p == nil {
+		return nil, packErr(ErrDataNil)
+	}
+	builder, err := vb.builder(vb.version)
+	if err != nil {
+		return nil, packErr(err)
+	}
+	p1 := &PKG{Action: p.Action, Data: p.Data, Meta: p.Meta.Clone()}
+	if err = vb.migrate(p1, vb.Latest(), vb.version); err != nil {
+		return nil, packErr(err)
+	}
+	b1, err := builder.Pack(p1)
+	if err != nil {
+		return
+	}
+	b = make([]byte, 1+len(b1))
+	b[0] = byte(vb.version)
+	copy(b[1:], b1)
+	return
+}
@@ -0,0 +1,39 @@
+package metrics
+
+// Counter 只增的计数, labels 为与注册时 labelNames 对应的值
+type Counter interface {
+	Add(delta float64, labels ...string)
+}
+
+// Gauge 可增减的数值
+type Gauge interface {
+	Set(value float64, labels ...string)
+	Add(delta float64, labels ...string)
+}
+
+// Histogram 分布统计
+type Histogram interface {
+	Observe(value float64, labels ...string)
+}
+
+// Metrics 指标的创建, 同名指标重复创建返回同一个
+type Metrics interface {
+	Counter(name, help string, labelNames ...string) Counter
+	Gauge(name, help string, labelNames ...string) Gauge
+	Histogram(name, help string, buckets []float64, labelNames ...string) Histogram
+}
+
+// DefBuckets 默认的时间分布区间, 单位秒
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type nop struct{}
+
+// Nop 不记录的指标实现
+var Nop Metrics = nop{}
+
+func (nop) Counter(string, string, ...string) Counter                { return nop{} }
+func (nop) Gauge(string, string, ...string) Gauge                    { return nop{} }
+func (nop) Histogram(string, string, []float64, ...string) Histogram { return nop{} }
+func (nop) Add(float64, ...string)                                   {}
+func (nop) Set(float64, ...string)                                   {}
+func (nop) Observe(float64, ...string)                               {}
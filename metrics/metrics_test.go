@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("sent_total", "Sent packages.", "host").Add(2, "a:1")
+	r.Counter("sent_total", "", "host").Add(-1, "a:1")
+	r.Gauge("depth", "Queue depth.").Set(3)
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "action")
+	h.Observe(0.05, "hello")
+	h.Observe(0.5, "hello")
+
+	if v, ok := r.Value("sent_total", "a:1"); !ok || v != 2 {
+		t.Error("expect counter 2, got", v)
+	}
+	// 查询不存在的序列不会创建
+	if _, ok := r.Value("sent_total", "b:1"); ok {
+		t.Error("expect missing series")
+	}
+	if _, ok := r.Count("missing_seconds"); ok {
+		t.Error("expect missing family")
+	}
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE depth gauge",
+		"depth 3",
+		"# HELP sent_total Sent packages.",
+		`sent_total{host="a:1"} 2`,
+		`latency_seconds_bucket{action="hello",le="0.1"} 1`,
+		`latency_seconds_bucket{action="hello",le="1"} 2`,
+		`latency_seconds_bucket{action="hello",le="+Inf"} 2`,
+		`latency_seconds_sum{action="hello"} 0.55`,
+		`latency_seconds_count{action="hello"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "b:1") || strings.Contains(out, "missing_seconds") {
+		t.Errorf("expect lookups not exported, got\n%s", out)
+	}
+}
+
+func TestRegistry_Mismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("sent_total", "", "host")
+	r.Counter("sent_total", "", "host")
+	for _, register := range []func(){
+		func() { r.Gauge("sent_total", "", "host") },
+		func() { r.Counter("sent_total", "", "host", "index") },
+		func() {
+			r.Histogram("latency_seconds", "", []float64{1})
+			r.Histogram("latency_seconds", "", []float64{2})
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expect panic on mismatched registration")
+				}
+			}()
+			register()
+		}()
+	}
+}
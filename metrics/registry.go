@@ -0,0 +1,287 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Registry 内存中的指标实现, 可输出 Prometheus 文本格式
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+type family struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	count   uint64
+	buckets []uint64
+}
+
+// family 返回名称对应的指标, 已存在时类型、标签名和桶需一致, 否则 panic
+func (r *Registry) family(name, help, typ string, buckets []float64, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || !equalStrings(f.labelNames, labelNames) || !equalFloats(f.buckets, buckets) {
+			panic(fmt.Sprintf("metrics error: %s registered as %s%v, got %s%v", name, f.typ, f.labelNames, typ, labelNames))
+		}
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (r *Registry) Counter(name, help string, labelNames ...string) Counter {
+	return r.family(name, help, counterType, nil, labelNames)
+}
+
+func (r *Registry) Gauge(name, help string, labelNames ...string) Gauge {
+	return r.family(name, help, gaugeType, nil, labelNames)
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) Histogram {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return r.family(name, help, histogramType, buckets, labelNames)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// key 标签值数量与标签名不一致时补空或截断
+func (f *family) key(labels []string) (string, []string) {
+	values := make([]string, len(f.labelNames))
+	copy(values, labels)
+	return strings.Join(values, "\xff"), values
+}
+
+// lookup 查找序列, 不存在时不创建
+func (f *family) lookup(labels []string) (*series, bool) {
+	key, _ := f.key(labels)
+	s, ok := f.series[key]
+	return s, ok
+}
+
+// get 获取标签对应的序列, 不存在时创建
+func (f *family) get(labels []string) *series {
+	key, values := f.key(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if f.typ == histogramType {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) Add(delta float64, labels ...string) {
+	if f.typ == counterType && delta < 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labels).value += delta
+}
+
+func (f *family) Set(value float64, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labels).value = value
+}
+
+func (f *family) Observe(value float64, labels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(labels)
+	s.value += value
+	s.count++
+	for i, b := range f.buckets {
+		if value <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Value 返回计数或数值, 直方图返回总和, 序列不存在返回 0, false 且不会创建序列
+func (r *Registry) Value(name string, labels ...string) (float64, bool) {
+	r.mu.RLock()
+	f, ok := r.families[name]
+	r.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.lookup(labels)
+	if !ok {
+		return 0, false
+	}
+	return s.value, true
+}
+
+// Count 返回直方图的观测次数, 序列不存在返回 0, false 且不会创建序列
+func (r *Registry) Count(name string, labels ...string) (uint64, bool) {
+	r.mu.RLock()
+	f, ok := r.families[name]
+	r.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.lookup(labels)
+	if !ok {
+		return 0, false
+	}
+	return s.count, true
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出所有指标
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.mu.RLock()
+		f := r.families[name]
+		r.mu.RUnlock()
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.help != "" {
+		w.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+	}
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.typ != histogramType {
+			w.WriteString(f.name + f.labels(s.labels, "", "") + " " + formatFloat(s.value) + "\n")
+			continue
+		}
+		for i, b := range f.buckets {
+			w.WriteString(f.name + "_bucket" + f.labels(s.labels, "le", formatFloat(b)) + " " + strconv.FormatUint(s.buckets[i], 10) + "\n")
+		}
+		w.WriteString(f.name + "_bucket" + f.labels(s.labels, "le", "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		w.WriteString(f.name + "_sum" + f.labels(s.labels, "", "") + " " + formatFloat(s.value) + "\n")
+		w.WriteString(f.name + "_count" + f.labels(s.labels, "", "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+func (f *family) labels(values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range f.labelNames {
+		pairs = append(pairs, name+`="`+escape(values[i], true)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler 以 Prometheus 文本格式输出指标的 http.Handler
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WritePrometheus(w)
+	})
+}
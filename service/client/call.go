@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/obnahsgnaw/socketutil/client"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"strconv"
+)
+
+var ErrUnexpectedData = errors.New("client error: unexpected data type")
+
+var ErrNoResponseStructure = errors.New("client error: no response structure")
+
+var ErrNoMessageId = errors.New("client error: package builder does not carry message id")
+
+type waiter struct {
+	ch chan *codec.PKG
+}
+
+// waitKey 回复按 action 和请求的 message-id 匹配
+type waitKey struct {
+	action    codec.ActionId
+	messageId string
+}
+
+func (c *Client) addWaiter(key waitKey) *waiter {
+	w := &waiter{ch: make(chan *codec.PKG, 1)}
+	c.waitLock.Lock()
+	c.waiters[key] = w
+	c.waitLock.Unlock()
+	return w
+}
+
+func (c *Client) delWaiter(key waitKey) {
+	c.waitLock.Lock()
+	delete(c.waiters, key)
+	c.waitLock.Unlock()
+}
+
+// deliver 将网关包交给 message-id 相同的调用, 没有匹配的等待者返回 false
+func (c *Client) deliver(pkg *codec.PKG) bool {
+	id := pkg.GetMeta(codec.MetaMessageId)
+	if id == "" {
+		return false
+	}
+	key := waitKey{action: pkg.Action, messageId: id}
+	c.waitLock.Lock()
+	w, ok := c.waiters[key]
+	delete(c.waiters, key)
+	c.waitLock.Unlock()
+	if !ok {
+		return false
+	}
+	w.ch <- pkg
+	return true
+}
+
+// Call 发送 action 并等待 respAction 的回复, 请求带有客户端内唯一的 message-id, 只接收 message-id 相同的回复, 对端回复时需带回该 id,
+// 包构建器不携带元数据时返回 ErrNoMessageId;
+// 回复数据按 structure 解码, structure 为空时使用注册表中 action 的 Response 或 respAction 的 Request, 都没有时返回 ErrNoResponseStructure
+func (c *Client) Call(ctx context.Context, action codec.Action, data codec.DataPtr, respAction codec.Action, structure DataStructure) (codec.DataPtr, error) {
+	if structure == nil && c.registry != nil {
+		if def, ok := c.registry.Lookup(action.Id); ok && def.Response != nil {
+			structure = def.Response
+		} else if def, ok = c.registry.Lookup(respAction.Id); ok && def.Request != nil {
+			structure = def.Request
+		}
+	}
+	if structure == nil {
+		return nil, NewWrappedError("call action["+action.Name+"] failed,", ErrNoResponseStructure)
+	}
+	if !c.protocol().carriesMeta() {
+		return nil, NewWrappedError("call action["+action.Name+"] failed,", ErrNoMessageId)
+	}
+	key := waitKey{action: respAction.Id, messageId: c.callPrefix + strconv.FormatUint(c.callIndex.Add(1), 10)}
+	w := c.addWaiter(key)
+	defer c.delWaiter(key)
+	if err := c.sendContext(ctx, action, data, codec.Meta{codec.MetaMessageId: key.messageId}); err != nil {
+		return nil, err
+	}
+	connCtx, _ := c.c.ConnContext()
+	select {
+	case <-ctx.Done():
+		return nil, NewWrappedError("call action["+action.Name+"] failed", ctx.Err())
+	case <-connCtx.Done():
+		return nil, NewWrappedError("call action["+action.Name+"] failed,", &client.TransportError{Op: client.OpRead, Err: client.ErrNotConnected})
+	case pkg := <-w.ch:
+		d := structure()
+		dbd := c.protocol().dbd
+		if err := dbd.Unpack(pkg.Data, d); err != nil {
+			return nil, NewWrappedError("call action["+action.Name+"] failed,", codec.NewBuilderError(codec.DataBuilderKind, dbd.Name(), codec.OpUnpack, err))
+		}
+		return d, nil
+	}
+}
+
+// ListenTyped 监听 action, 请求数据解码为 *Req, 返回的 *Resp 以 respAction 回复, 返回 nil 不回复
+func ListenTyped[Req, Resp any](c *Client, action, respAction codec.Action, handler func(ctx context.Context, rq *Req) (*Resp, error)) {
+	c.ListenContext(action, func() codec.DataPtr {
+		return new(Req)
+	}, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		rq, ok := rqData.(*Req)
+		if !ok {
+			return codec.Action{}, nil, fmt.Errorf("action[%s] %w: %T", action.Name, ErrUnexpectedData, rqData)
+		}
+		resp, err := handler(ctx, rq)
+		if err != nil || resp == nil {
+			return codec.Action{}, nil, err
+		}
+		return respAction, resp, nil
+	})
+}
+
+// CallTyped 发送 *Req 并等待 respAction 的回复解码为 *Resp
+func CallTyped[Req, Resp any](ctx context.Context, c *Client, action codec.Action, rq *Req, respAction codec.Action) (*Resp, error) {
+	d, err := c.Call(ctx, action, rq, respAction, func() codec.DataPtr {
+		return new(Resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := d.(*Resp)
+	if !ok {
+		return nil, fmt.Errorf("action[%s] %w: %T", respAction.Name, ErrUnexpectedData, d)
+	}
+	return resp, nil
+}
@@ -2,12 +2,16 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"github.com/obnahsgnaw/socketutil/client"
 	"github.com/obnahsgnaw/socketutil/codec"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"log"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,51 +24,95 @@ type Handler func(rqData codec.DataPtr) (respAction codec.Action, respData codec
 type Client struct {
 	c                 *client.Client
 	handlers          sync.Map
-	cdc               codec.Codec
-	pgb               codec.PkgBuilder
-	dbd               codec.DataBuilder
-	pkgInterceptor    PkgInterceptor
+	defaults          protocol
+	current           atomic.Pointer[protocol]
+	negotiator        *Negotiator
+	negotiation       atomic.Pointer[negotiation]
 	listenInterceptor func([]byte) []byte
-	actWatcher        func(action codec.Action, msg string)
-	pkgWatcher        func(mtp client.MsgType, msg string, pkg []byte)
-	logWatcher        func(level zapcore.Level, msg string)
+	logger            *logger
+	mwLock            sync.RWMutex
+	middlewares       []Middleware
+	errorMapper       ErrorMapper
+	requestIndex      atomic.Uint64
+	callPrefix        string
+	callIndex         atomic.Uint64
+	waitLock          sync.Mutex
+	waiters           map[waitKey]*waiter
+	dispatcher        *dispatcher
+	handlerTimeout    time.Duration
+	hLock             sync.RWMutex
+	ranges            []rangeHandler
+	defaultHandler    DefaultHandler
+	streamBuffer      int
+	streams           sync.WaitGroup
+	stopOnce          sync.Once
+	done              chan struct{}
+	tracer            Tracer
+	registry          *codec.ActionRegistry
+	metrics           *serviceMetrics
 }
 
 type listenHandler struct {
 	action    codec.Action
 	structure DataStructure
-	handler   Handler
+	handler   ContextHandler
 }
 
 func New(ctx context.Context, network string, host string, cdc codec.Codec, pgb codec.PkgBuilder, dbd codec.DataBuilder, options ...Option) *Client {
 	c := &Client{
-		c:   client.New(ctx, network, host),
-		cdc: cdc,
-		pgb: pgb,
-		dbd: dbd,
-		actWatcher: func(action codec.Action, msg string) {
-			log.Println("action[", action.Name, "]", msg)
-		},
-		pkgWatcher: func(mtp client.MsgType, msg string, pkg []byte) {
-			log.Println(mtp.String(), len(pkg), "types pkg:", pkg)
-		},
-		logWatcher: func(level zapcore.Level, msg string) {
-			log.Println(msg)
-		},
+		c:            client.New(ctx, network, host),
+		defaults:     protocol{cdc: cdc, pgb: pgb, dbd: dbd},
+		waiters:      make(map[waitKey]*waiter),
+		callPrefix:   callPrefix(),
+		dispatcher:   newDispatcher(),
+		streamBuffer: 16,
+		done:         make(chan struct{}),
+		tracer:       noopTracer{},
+		metrics:      newServiceMetrics(nil),
 	}
+	c.logger = newLogger(c.c.Log())
+	c.c.With(client.WsMessage(wsMessageType(dbd.Name())))
 	c.With(options...)
 	c.c.With(client.Message(c.dispatch))
 
 	return c
 }
 
+// callPrefix Call 的 message-id 前缀, 随机生成以免与对端或其他客户端的 id 冲突
+func callPrefix() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b) + "-"
+}
+
+// json 等文本数据使用 TextMessage, 其他二进制数据使用 BinaryMessage 避免代理的 UTF-8 校验
+func wsMessageType(name codec.Name) client.WsMessageType {
+	switch name {
+	case codec.Json, codec.ProtoJson, codec.ProtoText:
+		return client.TextMessage
+	}
+	return client.BinaryMessage
+}
+
 func (c *Client) With(options ...Option) {
 	for _, o := range options {
 		o(c)
 	}
+	// 未协商或尚未连接时默认协议的修改立即生效, 协商完成后由握手替换
+	if c.negotiator == nil || c.current.Load() == nil {
+		c.useProtocol(nil)
+	}
 }
 
 func (c *Client) Listen(action codec.Action, structure DataStructure, handler Handler) {
+	c.ListenContext(action, structure, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		respAction, respData := handler(rqData)
+		return respAction, respData, nil
+	})
+}
+
+// ListenContext 监听 action, 处理器接收每条消息的 context 并可返回错误
+func (c *Client) ListenContext(action codec.Action, structure DataStructure, handler ContextHandler) {
 	c.addHandler(listenHandler{
 		action:    action,
 		structure: structure,
@@ -79,48 +127,132 @@ func (c *Client) SendRaw(b []byte) (err error) {
 	return
 }
 
+// Send 经过中间件封包发送, 设置了 action 注册表时拒绝未注册的 action
 func (c *Client) Send(action codec.Action, data codec.DataPtr) (err error) {
+	return c.SendWithMeta(action, data, nil)
+}
+
+// SendWithMeta 携带元数据发送
+func (c *Client) SendWithMeta(action codec.Action, data codec.DataPtr, meta codec.Meta) (err error) {
+	ctx, _ := c.c.ConnContext()
+	return c.sendContext(ctx, action, data, meta)
+}
+
+// SendContext 发送并以 ctx 中的链路作为上级 span, traceparent 随元数据传播
+func (c *Client) SendContext(ctx context.Context, action codec.Action, data codec.DataPtr) (err error) {
+	return c.sendContext(ctx, action, data, nil)
+}
+
+func (c *Client) sendContext(ctx context.Context, action codec.Action, data codec.DataPtr, meta codec.Meta) (err error) {
+	if c.registry != nil {
+		def, ok := c.registry.Lookup(action.Id)
+		if !ok {
+			return NewWrappedError("send action["+action.String()+"] failed", codec.ErrUnknownAction)
+		}
+		if action.Name == "" {
+			action.Name = def.Action.Name
+		}
+	}
+	ctx, span := c.startSpan(ctx, "send action["+action.String()+"]", nil)
+	defer span.End()
+	meta = meta.Clone()
+	if meta == nil {
+		meta = make(codec.Meta)
+	}
+	c.tracer.Inject(ctx, meta)
+	if err = c.invoke(&Invocation{
+		Ctx:       ctx,
+		Direction: client.Send,
+		Action:    action,
+		Data:      data,
+		Meta:      meta,
+	}, c.send); err != nil {
+		span.RecordError(err)
+	}
+	return
+}
+
+func (c *Client) send(inv *Invocation) (err error) {
 	var b2 []byte
 
-	if b2, err = c.Pack(action, data); err != nil {
+	if err = c.waitNegotiation(inv.Ctx); err != nil {
+		return NewWrappedError("send action["+inv.Action.Name+"] failed", err)
+	}
+
+	if inv.Pkg, b2, err = c.pack(SpanFrom(inv.Ctx), inv.Action, inv.Data, inv.Meta); err != nil {
 		return
 	}
 
 	if err = c.SendRaw(b2); err != nil {
-		err = NewWrappedError("send action["+action.Name+"] failed", err)
+		err = NewWrappedError("send action["+inv.Action.Name+"] failed", err)
 	}
 
 	return
 }
 
+// Pack 封包不发送, 设置了链路追踪时 traceparent 写入元数据
 func (c *Client) Pack(action codec.Action, data codec.DataPtr) ([]byte, error) {
+	return c.PackContext(context.Background(), action, data)
+}
+
+// PackContext 封包不发送, 以 ctx 中的链路作为上级 span
+func (c *Client) PackContext(ctx context.Context, action codec.Action, data codec.DataPtr) ([]byte, error) {
+	ctx, span := c.startSpan(ctx, "pack action["+action.String()+"]", nil)
+	defer span.End()
+	meta := make(codec.Meta)
+	c.tracer.Inject(ctx, meta)
+	_, b, err := c.pack(span, action, data, meta)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return b, err
+}
+
+func (c *Client) pack(span Span, action codec.Action, data codec.DataPtr, meta codec.Meta) (*codec.PKG, []byte, error) {
+	p := c.protocol()
 	// data封包
-	b, err := c.dbd.Pack(data)
+	b, err := p.dbd.Pack(data)
 	if err != nil {
-		return nil, NewWrappedError("send action["+action.Name+"] failed,pack data failed", err)
+		c.metrics.codecError(stageEncode)
+		return nil, nil, NewWrappedError("send action["+action.Name+"] failed,", codec.NewBuilderError(codec.DataBuilderKind, p.dbd.Name(), codec.OpPack, err))
 	}
+	span.AddEvent("data encoded")
 	// action封包
-	b1, err := c.pgb.Pack(&codec.PKG{
+	pkg := &codec.PKG{
 		Action: action.Id,
 		Data:   b,
-	})
+		Meta:   meta.Clone(),
+	}
+	if mi, ok := p.interceptor.(PkgMetaInterceptor); ok {
+		if err = mi.InterceptPkg(client.Send, pkg); err != nil {
+			c.metrics.interceptorError(client.Send)
+			return nil, nil, NewWrappedError("send action["+action.Name+"] failed,", &InterceptorError{Direction: client.Send, Op: OpIntercept, Err: err})
+		}
+	}
+	b1, err := p.pgb.Pack(pkg)
 	if err != nil {
-		return nil, NewWrappedError("send action["+action.Name+"] failed,pack gateway package failed", err)
+		c.metrics.codecError(stagePack)
+		return nil, nil, NewWrappedError("send action["+action.Name+"] failed,", codec.NewBuilderError(codec.PkgBuilderKind, "", codec.OpPack, err))
 	}
+	span.AddEvent("package encoded")
 	// 拦截器封包
-	if c.pkgInterceptor != nil {
-		b1, err = c.pkgInterceptor.Encode(b1)
+	if p.interceptor != nil {
+		b1, err = p.interceptor.Encode(b1)
 		if err != nil {
-			return nil, NewWrappedError("send action["+action.Name+"] failed, interceptor encode package failed", err)
+			c.metrics.interceptorError(client.Send)
+			return nil, nil, NewWrappedError("send action["+action.Name+"] failed,", &InterceptorError{Direction: client.Send, Op: OpEncode, Err: err})
 		}
+		span.AddEvent("interceptor encoded")
 	}
 	// codec封包
-	b2, err := c.cdc.Marshal(b1)
+	b2, err := p.cdc.Marshal(b1)
 	if err != nil {
-		return nil, NewWrappedError("send action["+action.Name+"] failed,pack codec package failed", err)
+		c.metrics.codecError(stageMarshal)
+		return nil, nil, NewWrappedError("send action["+action.Name+"] failed,", codec.NewCodecError(codec.OpMarshal, err))
 	}
+	span.AddEvent("codec encoded")
 
-	return b2, nil
+	return pkg, b2, nil
 }
 
 func (c *Client) Heartbeat(pkg []byte, interval time.Duration) {
@@ -135,12 +267,69 @@ func (c *Client) HeartbeatContinue() {
 	c.c.HeartbeatContinue()
 }
 
+func (c *Client) Host() string {
+	return c.c.Host()
+}
+
+func (c *Client) Endpoints() []client.Endpoint {
+	return c.c.Endpoints()
+}
+
+func (c *Client) State() client.State {
+	return c.c.State()
+}
+
+func (c *Client) Subscribe(size int) (<-chan client.StateChange, func()) {
+	return c.c.Subscribe(size)
+}
+
+func (c *Client) WaitConnected(ctx context.Context) error {
+	return c.c.WaitConnected(ctx)
+}
+
 func (c *Client) Start() {
 	c.c.Start()
 }
 
+// Stop 停止客户端, 等待已接收的消息处理完成和流发送协程退出, 可重复调用.
+// 处理器执行期间调用时只发出停止信号不等待, 可通过 Done 等待
 func (c *Client) Stop() {
-	c.c.Stop()
+	c.stopOnce.Do(func() {
+		c.dispatcher.close()
+		c.c.Stop()
+		go func() {
+			<-c.c.Done()
+			<-c.dispatcher.done
+			c.streams.Wait()
+			close(c.done)
+		}()
+	})
+	if !c.dispatcher.busy() {
+		<-c.done
+	}
+}
+
+// Done 停止后消息处理和流发送全部结束时关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// actionOf 根据注册表补全 action 名称
+func (c *Client) actionOf(id codec.ActionId) codec.Action {
+	if c.registry != nil {
+		return c.registry.Action(id)
+	}
+	return codec.NewAction(id, "")
+}
+
+// requestStructure 注册表提供的请求数据结构, 没有时不解码数据
+func (c *Client) requestStructure(id codec.ActionId) DataStructure {
+	if c.registry != nil {
+		if def, ok := c.registry.Lookup(id); ok && def.Request != nil {
+			return def.Request
+		}
+	}
+	return noData
 }
 
 func (c *Client) addHandler(handler listenHandler) {
@@ -151,7 +340,7 @@ func (c *Client) delHandler(id codec.ActionId) {
 	c.handlers.Delete(id)
 }
 
-func (c *Client) getHandler(id codec.ActionId) (DataStructure, codec.Action, Handler, bool) {
+func (c *Client) getHandler(id codec.ActionId) (DataStructure, codec.Action, ContextHandler, bool) {
 	h, ok := c.handlers.Load(id)
 	if ok {
 		h1 := h.(listenHandler)
@@ -163,12 +352,10 @@ func (c *Client) getHandler(id codec.ActionId) (DataStructure, codec.Action, Han
 
 func (c *Client) dispatch(pkg []byte) {
 	defer RecoverHandler("client server dispatcher", func(err, stack string) {
-		c.logWatcher(zapcore.ErrorLevel, "package dispatcher: dispatch failed, err="+err+", stack="+stack)
+		c.logger.Print(zapcore.ErrorLevel, "package dispatcher: dispatch failed", append(c.fields(), zap.String("error", err), zap.String(FieldStack, stack))...)
 	})
 	// 沾包拼包
-	var err error
 	tmp := c.c.Tmp
-	c.c.Tmp = nil
 	if len(tmp) > 0 {
 		pkg = append(tmp, pkg...)
 	}
@@ -179,52 +366,176 @@ func (c *Client) dispatch(pkg []byte) {
 			return
 		}
 	}
+	// 协商回复
+	var ok bool
+	if pkg, ok = c.negotiateDispatch(pkg); !ok {
+		return
+	}
 	// 沾包拆包
-	c.c.Tmp, err = c.cdc.Unmarshal(pkg, func(codePkg []byte) {
-		c.pkgWatcher(client.Receive, "codec package", codePkg)
-		// 拦截器解码
-		if c.pkgInterceptor != nil {
-			var err1 error
-			if codePkg, err1 = c.pkgInterceptor.Decode(codePkg); err1 != nil {
-				c.logWatcher(zapcore.ErrorLevel, "package dispatcher: interceptor decode package failed, err="+err1.Error())
-				return
-			}
-		}
-		// 网关层的包拆包
-		gatewayPackage, err1 := c.pgb.Unpack(codePkg)
-		if err1 != nil {
-			c.logWatcher(zapcore.ErrorLevel, "package dispatcher: unpack gateway package failed, err="+err1.Error())
+	var tmp1 []byte
+	defer func() {
+		// 剩余数据复制保存, 不与下一次拼包共享底层数组
+		c.c.Tmp = append([]byte(nil), tmp1...)
+	}()
+	p := c.protocol()
+	tmp1, err := p.cdc.Unmarshal(pkg, func(codePkg []byte) {
+		c.dispatchPackage(p, codePkg)
+	})
+	if err != nil {
+		c.metrics.codecError(stageUnmarshal)
+		err = codec.NewCodecError(codec.OpUnmarshal, err)
+		c.logger.Print(zapcore.ErrorLevel, "dispatcher: codec package failed", append(c.fields(), zap.Int(client.FieldSize, len(pkg)), zap.Error(err))...)
+	}
+}
+
+// dispatchPackage 拆出一个 codec 包后解码并提交给调度器处理
+func (c *Client) dispatchPackage(p *protocol, codePkg []byte) {
+	c.logger.Package(client.Receive, "codec package", codePkg, c.fields()...)
+	// 拦截器解码
+	if p.interceptor != nil {
+		decoded, err := p.interceptor.Decode(codePkg)
+		if err != nil {
+			c.metrics.interceptorError(client.Receive)
+			err = &InterceptorError{Direction: client.Receive, Op: OpDecode, Err: err}
+			c.logger.Print(zapcore.ErrorLevel, "package dispatcher: interceptor decode package failed", append(c.fields(), zap.Int(client.FieldSize, len(codePkg)), zap.Error(err))...)
 			return
 		}
-		// 获取action
-		ds, action, handler, ok := c.getHandler(gatewayPackage.Action)
-		if !ok {
-			c.logWatcher(zapcore.WarnLevel, "package dispatcher: no action["+strconv.Itoa(int(gatewayPackage.Action))+"] handler")
+		codePkg = decoded
+	}
+	// 网关层的包拆包
+	gatewayPackage, err := p.pgb.Unpack(codePkg)
+	if err != nil {
+		c.metrics.codecError(stageUnpack)
+		err = codec.NewBuilderError(codec.PkgBuilderKind, "", codec.OpUnpack, err)
+		c.logger.Print(zapcore.ErrorLevel, "package dispatcher: unpack gateway package failed", append(c.fields(), zap.Int(client.FieldSize, len(codePkg)), zap.Error(err))...)
+		return
+	}
+	if mi, ok := p.interceptor.(PkgMetaInterceptor); ok {
+		if err = mi.InterceptPkg(client.Receive, gatewayPackage); err != nil {
+			c.metrics.interceptorError(client.Receive)
+			err = &InterceptorError{Direction: client.Receive, Op: OpIntercept, Err: err}
+			c.logger.action(zapcore.ErrorLevel, c.actionOf(gatewayPackage.Action), "package dispatcher: interceptor intercept package failed", append(c.fields(), zap.Error(err))...)
 			return
 		}
-		c.actWatcher(action, "handle start")
-		// data 解码
-		d := ds()
-		if err = c.dbd.Unpack(gatewayPackage.Data, d); err != nil {
-			c.actWatcher(action, "data decode failed, err="+err.Error())
+	}
+	// 等待回复的调用
+	if c.deliver(gatewayPackage) {
+		return
+	}
+	// 获取action
+	ds, action, handler, ok := c.lookup(gatewayPackage)
+	if !ok {
+		c.logger.action(zapcore.WarnLevel, c.actionOf(gatewayPackage.Action), "package dispatcher: no action handler", c.fields()...)
+		return
+	}
+	if ds == nil {
+		ds = c.requestStructure(action.Id)
+	}
+	c.logger.action(zapcore.DebugLevel, action, "handle start", append(c.fields(), zap.Int(client.FieldSize, len(gatewayPackage.Data)))...)
+	// 链路从上游的 traceparent 继续
+	connCtx, connIndex := c.c.ConnContext()
+	ctx, span := c.startSpan(connCtx, "handle action["+action.String()+"]", gatewayPackage.Meta)
+	span.AddEvent("package decoded")
+	// data 解码
+	d := ds()
+	if err = p.dbd.Unpack(gatewayPackage.Data, d); err != nil {
+		c.metrics.codecError(stageDecode)
+		err = codec.NewBuilderError(codec.DataBuilderKind, p.dbd.Name(), codec.OpUnpack, err)
+		c.logger.action(zapcore.ErrorLevel, action, "data decode failed", append(c.fields(), zap.Int(client.FieldSize, len(gatewayPackage.Data)), zap.Error(err))...)
+		span.RecordError(err)
+		span.End()
+		return
+	}
+	span.AddEvent("data decoded")
+	// 处理
+	requestId := gatewayPackage.GetMeta(codec.MetaMessageId)
+	if requestId == "" {
+		requestId = strconv.FormatUint(c.requestIndex.Add(1), 10)
+	}
+	inv := &Invocation{
+		Ctx:       withMeta(withMessage(ctx, action, connIndex, requestId), gatewayPackage.Meta),
+		Direction: client.Receive,
+		Action:    action,
+		Pkg:       gatewayPackage,
+		Data:      d,
+		Meta:      gatewayPackage.Meta,
+	}
+	c.dispatcher.submit(c.c.Host(), inv, func() {
+		c.handle(inv, handler)
+	})
+}
+
+// handle 执行中间件和处理器并回复
+func (c *Client) handle(inv *Invocation, handler ContextHandler) {
+	defer RecoverHandler("client server handler", func(err, stack string) {
+		c.logger.action(zapcore.ErrorLevel, inv.Action, "package dispatcher: handle action failed", append(c.fields(), zap.String("error", err), zap.String(FieldStack, stack))...)
+	})
+	action := inv.Action
+	span := SpanFrom(inv.Ctx)
+	defer span.End()
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.handlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(inv.Ctx, c.handlerTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(inv.Ctx)
+	}
+	defer cancel()
+	inv.Ctx = ctx
+
+	span.AddEvent("handler start")
+	start := time.Now()
+	err := c.invoke(inv, func(inv *Invocation) (err error) {
+		if c.handlerTimeout <= 0 {
+			inv.RespAction, inv.RespData, err = handler(inv.Ctx, inv.Data)
 			return
 		}
-		// 处理
-		respAction, respData := handler(d)
-		if respAction.Id <= 0 {
-			c.actWatcher(action, "handle success, but no response")
-			return
+		// 超时后不再等待处理器返回, 其结果被丢弃
+		type result struct {
+			action codec.Action
+			data   codec.DataPtr
+			err    error
 		}
-		// 回复
-		if err = c.Send(respAction, respData); err != nil {
-			c.logWatcher(zapcore.ErrorLevel, "dispatcher: response action["+action.Name+"] failed,err="+err.Error())
-
-			c.actWatcher(action, "handle success, but response failed, err="+err.Error())
+		done := make(chan result, 1)
+		go func() {
+			defer RecoverHandler("client server handler", func(e, stack string) {
+				done <- result{err: errors.New("panic: " + e)}
+			})
+			a, d, e := handler(inv.Ctx, inv.Data)
+			done <- result{a, d, e}
+		}()
+		select {
+		case r := <-done:
+			inv.RespAction, inv.RespData, err = r.action, r.data, r.err
+		case <-inv.Ctx.Done():
+			err = NewWrappedError("handle timeout", inv.Ctx.Err())
 		}
-
-		c.actWatcher(action, "handle success, response action="+respAction.String())
+		return
 	})
+	span.AddEvent("handler end")
+	c.metrics.handled(action, time.Since(start), err)
 	if err != nil {
-		c.logWatcher(zapcore.ErrorLevel, "dispatcher: codec package failed, err="+err.Error())
+		span.RecordError(err)
+		c.logger.action(zapcore.ErrorLevel, action, "handle failed", append(c.fields(), zap.String(FieldRequestId, RequestIdFrom(inv.Ctx)), zap.Error(err))...)
+		if c.errorMapper == nil {
+			return
+		}
+		inv.RespAction, inv.RespData = c.errorMapper(inv.Ctx, action, err)
 	}
+	respAction, respData := inv.RespAction, inv.RespData
+	if respAction.Id <= 0 {
+		c.logger.action(zapcore.InfoLevel, action, "handle success, but no response", append(c.fields(), zap.String(FieldRequestId, RequestIdFrom(inv.Ctx)))...)
+		return
+	}
+	// 回复, 带回请求的 message-id 以便调用方匹配
+	var respMeta codec.Meta
+	if id := inv.Meta.Get(codec.MetaMessageId); id != "" {
+		respMeta = codec.Meta{codec.MetaMessageId: id}
+	}
+	if err = c.sendContext(inv.Ctx, respAction, respData, respMeta); err != nil {
+		c.logger.action(zapcore.ErrorLevel, action, "handle success, but response failed", append(c.fields(), zap.String(FieldRequestId, RequestIdFrom(inv.Ctx)), zap.Stringer("response", respAction), zap.Error(err))...)
+		return
+	}
+
+	c.logger.action(zapcore.InfoLevel, action, "handle success", append(c.fields(), zap.String(FieldRequestId, RequestIdFrom(inv.Ctx)), zap.Stringer("response", respAction))...)
 }
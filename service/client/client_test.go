@@ -0,0 +1,1041 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/obnahsgnaw/socketutil/client"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"github.com/obnahsgnaw/socketutil/metrics"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type envelope struct {
+	Action uint32 `json:"action"`
+	Data   []byte `json:"data"`
+}
+
+type hello struct {
+	Name string `json:"name"`
+}
+
+var helloAction = codec.NewAction(1, "hello")
+
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l.Addr().String()
+}
+
+func newJsonClient(t *testing.T, options ...Option) *Client {
+	pgb := codec.NewJsonPackageBuilder(func(p *codec.PKG) codec.DataPtr {
+		return &envelope{Action: p.Action.Val(), Data: p.Data}
+	}, func(d codec.DataPtr) *codec.PKG {
+		e := d.(*envelope)
+		return &codec.PKG{Action: codec.ActionId(e.Action), Data: e.Data}
+	})
+	options = append([]Option{
+		Logger(func(level zapcore.Level, msg string) {}),
+		PackageLogger(nil),
+		ActionLogger(nil),
+	}, options...)
+	c := New(context.Background(), "tcp", echoServer(t), codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), pgb, codec.NewJsonDataBuilder(), options...)
+	c.Start()
+	t.Cleanup(c.Stop)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient_Use(t *testing.T) {
+	c := newJsonClient(t)
+	var mu sync.Mutex
+	var directions []client.MsgType
+	c.Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			mu.Lock()
+			directions = append(directions, inv.Direction)
+			mu.Unlock()
+			err := next(inv)
+			if inv.Pkg == nil || inv.Pkg.Action != helloAction.Id {
+				t.Error("expect gateway package of action hello")
+			}
+			return err
+		}
+	})
+	received := make(chan string, 1)
+	c.Listen(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		received <- rqData.(*hello).Name
+		return
+	})
+
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-received:
+		if name != "world" {
+			t.Error("expect world, got", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(directions) != 2 || directions[0] != client.Send || directions[1] != client.Receive {
+		t.Error("expect send then receive, got", directions)
+	}
+}
+
+func TestClient_ListenContext(t *testing.T) {
+	errAction := codec.NewAction(2, "error")
+	c := newJsonClient(t, ErrorResponse(ErrorAction(errAction, func(ctx context.Context, action codec.Action, err error) codec.DataPtr {
+		return &hello{Name: action.Name + ":" + err.Error()}
+	})))
+	c.ListenContext(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		if a, ok := ActionFrom(ctx); !ok || a.Id != helloAction.Id {
+			t.Error("expect action in context")
+		}
+		if ConnIndexFrom(ctx) != 1 || RequestIdFrom(ctx) == "" {
+			t.Error("expect connection index and request id in context")
+		}
+		return codec.Action{}, nil, errors.New("denied")
+	})
+	received := make(chan string, 1)
+	c.Listen(errAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		received <- rqData.(*hello).Name
+		return
+	})
+
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "hello:denied" {
+			t.Error("expect hello:denied, got", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+}
+
+func TestCallTyped(t *testing.T) {
+	c := newJsonClient(t)
+	greetAction := codec.NewAction(3, "greet")
+	ListenTyped(c, greetAction, helloAction, func(ctx context.Context, rq *hello) (*hello, error) {
+		return &hello{Name: "hi " + rq.Name}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	resp, err := CallTyped[hello, hello](ctx, c, greetAction, &hello{Name: "world"}, helloAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "hi world" {
+		t.Error("expect hi world, got", resp.Name)
+	}
+}
+
+func TestClient_DispatchKeyed(t *testing.T) {
+	c := newJsonClient(t, Dispatch(Keyed, 4, 10))
+	slowAction := codec.NewAction(6, "slow")
+	release := make(chan struct{})
+	defer close(release)
+	c.Listen(slowAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		<-release
+		return
+	})
+	received := make(chan string, 1)
+	c.Listen(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		received <- rqData.(*hello).Name
+		return
+	})
+
+	if err := c.Send(slowAction, &hello{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("hello blocked by slow action")
+	}
+}
+
+func TestClient_StopInHandler(t *testing.T) {
+	for _, mode := range []DispatchMode{Sequential, Pool, Keyed} {
+		c := newJsonClient(t, Dispatch(mode, 2, 10))
+		stopped := make(chan struct{})
+		c.Listen(helloAction, func() codec.DataPtr {
+			return &hello{}
+		}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+			c.Stop()
+			close(stopped)
+			return
+		})
+
+		if err := c.Send(helloAction, &hello{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-stopped:
+		case <-time.After(time.Second * 5):
+			t.Fatal(mode, "stop in handler deadlocked")
+		}
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second * 5):
+			t.Fatal(mode, "dispatcher not stopped")
+		}
+	}
+}
+
+func TestDispatcher_SubmitAfterClose(t *testing.T) {
+	d := newDispatcher()
+	d.mode, d.workers, d.queueSize = Pool, 1, 1
+	release := make(chan struct{})
+	running := make(chan struct{})
+	d.submit("", nil, func() {
+		close(running)
+		<-release
+	})
+	<-running
+	var ran atomic.Int32
+	d.submit("", nil, func() { ran.Add(1) })
+	// 队列已满, 发送阻塞直到关闭
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		d.submit("", nil, func() { ran.Add(10) })
+	}()
+	time.Sleep(time.Millisecond * 20)
+	d.close()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second * 5):
+		t.Fatal("submit blocked after close")
+	}
+	d.submit("", nil, func() { ran.Add(100) })
+	close(release)
+	<-d.done
+	if n := ran.Load(); n != 1 {
+		t.Error("expect only the queued task ran, got", n)
+	}
+	if n := d.depth.Load(); n != 0 {
+		t.Error("expect depth 0, got", n)
+	}
+}
+
+func TestClient_ListenRangeAndDefault(t *testing.T) {
+	c := newJsonClient(t)
+	received := make(chan string, 2)
+	c.ListenRange("plugin", 1000, 1999, func() codec.DataPtr {
+		return &hello{}
+	}, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		a, _ := ActionFrom(ctx)
+		received <- a.String()
+		return codec.Action{}, nil, nil
+	})
+	c.ListenDefault(func(ctx context.Context, pkg *codec.PKG) (codec.Action, codec.DataPtr, error) {
+		received <- "default:" + pkg.Action.String()
+		return codec.Action{}, nil, nil
+	})
+	c.Listen(helloAction, nil, nil)
+	c.Unlisten(helloAction)
+	if len(c.Handlers()) != 0 || len(c.HandlerRanges()) != 1 {
+		t.Error("unexpected handlers", c.Handlers(), c.HandlerRanges())
+	}
+
+	for _, a := range []codec.Action{codec.NewAction(1500, "x"), helloAction} {
+		if err := c.Send(a, &hello{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			expect := "1500:plugin"
+			if a.Id == helloAction.Id {
+				expect = "default:1"
+			}
+			if msg != expect {
+				t.Error("expect", expect, "got", msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("receive timeout")
+		}
+	}
+}
+
+func TestClient_ListenStream(t *testing.T) {
+	c := newJsonClient(t, Dispatch(Pool, 2, 10), StreamBuffer(1))
+	pageAction := codec.NewAction(7, "page")
+	c.ListenStream(pageAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(ctx context.Context, rqData codec.DataPtr, stream *Stream) error {
+		for _, name := range []string{"a", "b", "c"} {
+			if err := stream.Send(helloAction, &hello{Name: name}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	received := make(chan string, 3)
+	c.Listen(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		received <- rqData.(*hello).Name
+		return
+	})
+
+	if err := c.Send(pageAction, &hello{}); err != nil {
+		t.Fatal(err)
+	}
+	var names string
+	for i := 0; i < 3; i++ {
+		select {
+		case name := <-received:
+			names += name
+		case <-time.After(time.Second * 5):
+			t.Fatal("receive timeout")
+		}
+	}
+	if len(names) != 3 {
+		t.Error("expect 3 responses, got", names)
+	}
+}
+
+func TestClient_StopWaitsStream(t *testing.T) {
+	c := newJsonClient(t)
+	pageAction := codec.NewAction(7, "page")
+	sending := make(chan struct{}, 1)
+	// 流的发送协程在中间件中停留, Stop 需等待其退出
+	c.Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			if inv.Direction == client.Send && inv.Action.Id == helloAction.Id {
+				sending <- struct{}{}
+				time.Sleep(time.Millisecond * 200)
+			}
+			return next(inv)
+		}
+	})
+	streams := make(chan *Stream, 1)
+	c.ListenStream(pageAction, nil, func(ctx context.Context, rqData codec.DataPtr, stream *Stream) error {
+		stream.Detach()
+		streams <- stream
+		return stream.Send(helloAction, &hello{})
+	})
+
+	if err := c.Send(pageAction, &hello{}); err != nil {
+		t.Fatal(err)
+	}
+	var s *Stream
+	select {
+	case s = <-streams:
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+	select {
+	case <-sending:
+	case <-time.After(time.Second * 5):
+		t.Fatal("send timeout")
+	}
+	c.Stop()
+	select {
+	case <-s.Done():
+	default:
+		t.Error("expect stream finished after stop")
+	}
+}
+
+func TestClient_Registry(t *testing.T) {
+	registry := codec.NewActionRegistry()
+	registry.MustRegister(codec.ActionDefinition{Action: codec.NewAction(1, "hello"), Request: func() codec.DataPtr {
+		return &hello{}
+	}})
+	c := newJsonClient(t, Registry(registry))
+	received := make(chan string, 1)
+	c.ListenContext(helloAction, nil, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		received <- rqData.(*hello).Name
+		return codec.Action{}, nil, nil
+	})
+
+	if err := c.Send(codec.NewAction(99, "unknown"), &hello{}); !errors.Is(err, codec.ErrUnknownAction) {
+		t.Error("expect unknown action error, got", err)
+	}
+	if err := c.Send(codec.Action{Id: 1}, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-received:
+		if name != "world" {
+			t.Error("expect world, got", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+}
+
+type tenantInterceptor struct{}
+
+func (tenantInterceptor) Encode(b []byte) ([]byte, error) { return b, nil }
+func (tenantInterceptor) Decode(b []byte) ([]byte, error) { return b, nil }
+func (tenantInterceptor) InterceptPkg(mtp client.MsgType, pkg *codec.PKG) error {
+	if mtp == client.Send {
+		pkg.SetMeta(codec.MetaTenant, "t1")
+	}
+	return nil
+}
+
+func TestClient_Meta(t *testing.T) {
+	c := newJsonClient(t, GatewayPkgInterceptor(tenantInterceptor{}))
+	received := make(chan codec.Meta, 1)
+	c.ListenContext(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		if RequestIdFrom(ctx) != "m1" {
+			t.Error("expect request id from message id, got", RequestIdFrom(ctx))
+		}
+		received <- MetaFrom(ctx)
+		return codec.Action{}, nil, nil
+	})
+
+	if err := c.SendWithMeta(helloAction, &hello{}, codec.Meta{codec.MetaMessageId: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case meta := <-received:
+		if meta.Get(codec.MetaTenant) != "t1" || meta.Get(codec.MetaMessageId) != "m1" {
+			t.Error("unexpected meta", meta)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+}
+
+func TestClient_Tracing(t *testing.T) {
+	spans := make(chan SpanData, 10)
+	tracer := NewW3CTracer(func(data SpanData) {
+		spans <- data
+	})
+	c := newJsonClient(t, Tracing(tracer))
+	handled := make(chan struct{})
+	c.ListenContext(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		if _, err := ParseTraceParent(MetaFrom(ctx).Get(codec.MetaTraceParent)); err != nil {
+			t.Error("expect traceparent in meta, err=", err)
+		}
+		close(handled)
+		return codec.Action{}, nil, nil
+	})
+
+	root, rootSpan := tracer.Start(context.Background(), "api", codec.Meta{
+		codec.MetaTraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	})
+	if err := c.SendContext(root, helloAction, &hello{}); err != nil {
+		t.Fatal(err)
+	}
+	rootSpan.End()
+	<-handled
+
+	byName := map[string]SpanData{}
+	for len(byName) < 3 {
+		select {
+		case s := <-spans:
+			byName[s.Name] = s
+		case <-time.After(time.Second * 5):
+			t.Fatal("span timeout", byName)
+		}
+	}
+	send, handle := byName["send action[1:hello]"], byName["handle action[1:hello]"]
+	if send.Context.String()[3:35] != "0af7651916cd43dd8448eb211c80319c" {
+		t.Error("expect trace id continued from upstream, got", send.Context)
+	}
+	if handle.Parent != send.Context || handle.Context.TraceId != send.Context.TraceId {
+		t.Error("expect handle span child of send span", handle.Parent, send.Context)
+	}
+	if len(handle.Events) == 0 {
+		t.Error("expect handle span events")
+	}
+}
+
+func TestClient_Metrics(t *testing.T) {
+	m := metrics.NewRegistry()
+	c := newJsonClient(t, Metrics(m))
+	c.ListenContext(helloAction, func() codec.DataPtr { return &hello{} }, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		return codec.Action{}, nil, errors.New("failed")
+	})
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if n, _ := m.Count(MetricHandlerDuration, helloAction.Name); n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handler metrics timeout")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if v, _ := m.Value(MetricHandlerErrors, helloAction.Name); v != 1 {
+		t.Error("expect 1 handler error, got", v)
+	}
+	host := c.Host()
+	if v, _ := m.Value(client.MetricSentPkgs, host); v != 1 {
+		t.Error("expect 1 sent package, got", v)
+	}
+	if v, _ := m.Value(client.MetricConnects, host); v != 1 {
+		t.Error("expect 1 connect, got", v)
+	}
+	if v, _ := m.Value(client.MetricReceivedBytes, host); v <= 0 {
+		t.Error("expect received bytes, got", v)
+	}
+	if _, ok := m.Value(client.MetricQueueDepth, host); !ok {
+		t.Error("expect queue depth labelled by host")
+	}
+}
+
+func TestClient_MetricsEndpoints(t *testing.T) {
+	m := metrics.NewRegistry()
+	addr := echoServer(t)
+	c := New(context.Background(), "tcp", "", codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), codec.NewDefaultProtobufPackageBuilder(), codec.NewJsonDataBuilder(),
+		Logger(func(level zapcore.Level, msg string) {}), PackageLogger(nil), ActionLogger(nil),
+		Endpoints(addr), Metrics(m), Dispatch(Pool, 1, 1))
+	done := make(chan struct{})
+	c.Listen(helloAction, func() codec.DataPtr { return &hello{} }, func(rqData codec.DataPtr) (codec.Action, codec.DataPtr) {
+		close(done)
+		return codec.Action{}, nil
+	})
+	c.Start()
+	t.Cleanup(c.Stop)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+	// 队列长度以当前连接的节点为标签, 而非 New 的空 host
+	for _, name := range []string{client.MetricQueueDepth, MetricDispatchDepth} {
+		if _, ok := m.Value(name, addr); !ok {
+			t.Error("expect", name, "labelled by", addr)
+		}
+		if _, ok := m.Value(name, ""); ok {
+			t.Error("expect", name, "not labelled by empty host")
+		}
+	}
+}
+
+func TestClient_ZapLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var actionMsgs []string
+	var mu sync.Mutex
+	c := newJsonClient(t, ZapLogger(zap.New(core)), PackageSampling(time.Second, 1, 0), ActionLogger(func(action codec.Action, msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		actionMsgs = append(actionMsgs, msg)
+	}))
+	done := make(chan struct{})
+	c.ListenContext(helloAction, func() codec.DataPtr { return &hello{} }, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		close(done)
+		return codec.Action{}, nil, nil
+	})
+	for i := 0; i < 3; i++ {
+		if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+	c.Stop()
+
+	connected := logs.FilterMessage("client connected").All()
+	if len(connected) != 1 || connected[0].ContextMap()[client.FieldHost] == "" {
+		t.Error("expect connected log with host, got", connected)
+	}
+	start := logs.FilterMessage("handle start").All()
+	if len(start) == 0 || start[0].ContextMap()[FieldActionName] != helloAction.Name {
+		t.Error("expect handle start log with action, got", start)
+	}
+	if n := logs.FilterMessage("raw package").FilterField(zap.Stringer(client.FieldType, client.Send)).Len(); n != 1 {
+		t.Error("expect sampled send package logs 1, got", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actionMsgs) == 0 {
+		t.Error("expect action watcher messages")
+	}
+}
+
+type failInterceptor struct{}
+
+func (failInterceptor) Encode(b []byte) ([]byte, error) { return nil, errors.New("encode failed") }
+func (failInterceptor) Decode(b []byte) ([]byte, error) { return b, nil }
+
+func TestClient_Errors(t *testing.T) {
+	c := newJsonClient(t)
+	err := c.Send(helloAction, make(chan int))
+	var be *codec.BuilderError
+	if !errors.As(err, &be) || be.Kind != codec.DataBuilderKind || be.Op != codec.OpPack {
+		t.Error("expect data builder pack error, got", err)
+	}
+
+	err = newJsonClient(t, GatewayPkgInterceptor(failInterceptor{})).Send(helloAction, &hello{})
+	var ie *InterceptorError
+	if !errors.As(err, &ie) || ie.Direction != client.Send || ie.Op != OpEncode {
+		t.Error("expect interceptor encode error, got", err)
+	}
+
+	c.Stop()
+	err = c.SendRaw([]byte("raw"))
+	var te *client.TransportError
+	if !errors.As(err, &te) || te.Op != client.OpWrite || !errors.Is(err, client.ErrStopped) || codec.IsTemporary(err) {
+		t.Error("expect non temporary transport error, got", err)
+	}
+}
+
+func TestClient_Negotiate(t *testing.T) {
+	msgpackPgb := codec.NewMsgpackPackageBuilder(func(p *codec.PKG) codec.DataPtr {
+		return &envelope{Action: p.Action.Val(), Data: p.Data}
+	}, func(d codec.DataPtr) *codec.PKG {
+		e := d.(*envelope)
+		return &codec.PKG{Action: codec.ActionId(e.Action), Data: e.Data}
+	})
+	peer := NewNegotiator(2).MinVersion(1).
+		Codec(msgpackPgb, codec.NewMsgpackDataBuilder()).
+		Framing(codec.FramingLength, codec.NewLengthCodec(0x0102, 1024))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, rest, err := ServeNegotiation(conn, peer)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(rest) > 0 {
+			_, _ = conn.Write(rest)
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	n := NewNegotiator(1).
+		Codec(codec.NewCborPackageBuilder(nil, nil), codec.NewCborDataBuilder()).
+		Codec(msgpackPgb, codec.NewMsgpackDataBuilder()).
+		Framing(codec.FramingLength, codec.NewLengthCodec(0x0102, 1024)).
+		Framing(codec.FramingDelimiter, codec.NewDelimiterCodec([]byte("\n"), []byte("\n")))
+	c := New(context.Background(), "tcp", l.Addr().String(), codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), nil, codec.NewJsonDataBuilder(),
+		Logger(func(level zapcore.Level, msg string) {}), PackageLogger(nil), ActionLogger(nil), Negotiate(n))
+	received := make(chan string, 1)
+	c.Listen(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		received <- rqData.(*hello).Name
+		return
+	})
+	c.Start()
+	t.Cleanup(c.Stop)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err = c.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a, err := c.Negotiated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 1 || a.Codec != codec.Msgpack || a.Framing != codec.FramingLength || c.Protocol() != codec.Msgpack {
+		t.Error("expect msgpack over length framing at version 1, got", a, c.Protocol())
+	}
+	if err = c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-received:
+		if name != "world" {
+			t.Error("expect world, got", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+
+	if a = n.Answer(codec.Offer{Version: 0}); a.Err() == nil {
+		t.Error("expect version below min rejected")
+	}
+}
+
+func TestClient_NegotiateBeforeConnect(t *testing.T) {
+	n := NewNegotiator(1).Codec(codec.NewDefaultJsonPackageBuilder(), codec.NewJsonDataBuilder())
+	c := New(context.Background(), "tcp", "127.0.0.1:1", codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), codec.NewDefaultJsonPackageBuilder(), codec.NewJsonDataBuilder(),
+		Logger(func(level zapcore.Level, msg string) {}), PackageLogger(nil), ActionLogger(nil), Negotiate(n))
+	// 握手完成前使用默认协议
+	if c.Protocol() != codec.Json {
+		t.Error("expect default json protocol, got", c.Protocol())
+	}
+	b, err := c.Pack(helloAction, &hello{Name: "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"action":1`)) {
+		t.Error("expect json package, got", string(b))
+	}
+	if err = c.Send(helloAction, &hello{Name: "world"}); !errors.Is(err, client.ErrNotConnected) {
+		t.Error("expect not connected, got", err)
+	}
+}
+
+func TestClient_PkgVersion(t *testing.T) {
+	envelopeBuilder := func() codec.PkgBuilder {
+		return codec.NewJsonPackageBuilder(func(p *codec.PKG) codec.DataPtr {
+			return &envelope{Action: p.Action.Val(), Data: p.Data}
+		}, func(d codec.DataPtr) *codec.PKG {
+			e := d.(*envelope)
+			return &codec.PKG{Action: codec.ActionId(e.Action), Data: e.Data}
+		})
+	}
+	vb := codec.NewVersionedPackageBuilder(2, envelopeBuilder()).
+		Register(1, envelopeBuilder()).
+		Upgrade(1, func(p *codec.PKG) error { p.Action -= 100; return nil }).
+		Downgrade(2, func(p *codec.PKG) error { p.Action += 100; return nil })
+	var mu sync.Mutex
+	var raw []byte
+	c := New(context.Background(), "tcp", echoServer(t), codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), vb, codec.NewJsonDataBuilder(),
+		Logger(func(level zapcore.Level, msg string) {}), ActionLogger(nil), PinPkgVersion(1),
+		PackageLogger(func(mtp client.MsgType, msg string, pkg []byte) {
+			if mtp == client.Receive && msg == "codec package" {
+				mu.Lock()
+				raw = append([]byte(nil), pkg...)
+				mu.Unlock()
+			}
+		}))
+	received := make(chan string, 1)
+	c.Listen(helloAction, func() codec.DataPtr {
+		return &hello{}
+	}, func(rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr) {
+		received <- rqData.(*hello).Name
+		return
+	})
+	c.Start()
+	t.Cleanup(c.Stop)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := c.PkgVersion(); !ok || v != 1 {
+		t.Error("expect pinned version 1, got", v, ok)
+	}
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-received:
+		if name != "world" {
+			t.Error("expect world, got", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+	mu.Lock()
+	if len(raw) == 0 || raw[0] != 1 || !strings.Contains(string(raw), `"action":101`) {
+		t.Error("expect version 1 package on the wire, got", string(raw))
+	}
+	mu.Unlock()
+
+	n := NewNegotiator(2).MinVersion(1)
+	if p, err := n.protocol(protocol{pgb: vb}, codec.Answer{Version: 1}); err != nil || p.pgb.(*codec.VersionedPackageBuilder).PackVersion() != 1 {
+		t.Error("expect negotiated version 1, got", err)
+	}
+	if _, err := NewNegotiator(3).MinVersion(3).protocol(protocol{pgb: vb}, codec.Answer{Version: 3}); !errors.Is(err, codec.ErrNegotiationFailed) {
+		t.Error("expect unsupported package version, got", err)
+	}
+}
+
+// opaqueCtx 不是标准库的 cancelCtx, 子 context 未取消时会留下一个 goroutine
+type opaqueCtx struct {
+	context.Context
+	done chan struct{}
+}
+
+func (c opaqueCtx) Done() <-chan struct{} { return c.done }
+
+func (c opaqueCtx) Err() error {
+	select {
+	case <-c.done:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+func TestClient_HandleTimeoutNoLeak(t *testing.T) {
+	c := newJsonClient(t, HandlerTimeout(time.Second))
+	parent := opaqueCtx{Context: context.Background(), done: make(chan struct{})}
+	defer close(parent.done)
+	handler := func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		return codec.Action{}, nil, nil
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 200; i++ {
+		c.handle(&Invocation{Ctx: parent, Direction: client.Receive, Action: helloAction}, handler)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if after := runtime.NumGoroutine(); after > before+20 {
+		t.Error("expect handler contexts released, goroutines from", before, "to", after)
+	}
+}
+
+func TestClient_ZapLoggerKeepsCallbacks(t *testing.T) {
+	var mu sync.Mutex
+	var logs, actions, pkgs int
+	c := newJsonClient(t,
+		Logger(func(level zapcore.Level, msg string) {
+			mu.Lock()
+			logs++
+			mu.Unlock()
+		}),
+		ActionLogger(func(action codec.Action, msg string) {
+			mu.Lock()
+			actions++
+			mu.Unlock()
+		}),
+		PackageLogger(func(mtp client.MsgType, msg string, pkg []byte) {
+			mu.Lock()
+			pkgs++
+			mu.Unlock()
+		}),
+		ZapLogger(zap.NewNop()),
+	)
+	done := make(chan struct{})
+	c.ListenContext(helloAction, func() codec.DataPtr { return &hello{} }, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		close(done)
+		return codec.Action{}, nil, nil
+	})
+	if err := c.Send(helloAction, &hello{Name: "world"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive timeout")
+	}
+	c.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if logs == 0 || actions == 0 || pkgs == 0 {
+		t.Error("expect callbacks set before ZapLogger kept, got", logs, actions, pkgs)
+	}
+	if c.logger.Log != c.c.Log() {
+		t.Error("expect logger shared with raw client")
+	}
+}
+
+func TestClient_CallCorrelation(t *testing.T) {
+	c := newJsonClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	// 回显服务按请求原样返回, 并发调用需各自收到自己的回复
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			resp, err := CallTyped[hello, hello](ctx, c, helloAction, &hello{Name: name}, helloAction)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.Name != name {
+				t.Error("expect", name, "got", resp.Name)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	// 没有 message-id 的推送不能完成等待中的调用
+	greetAction := codec.NewAction(3, "greet")
+	pushed := make(chan struct{}, 1)
+	c.Listen(helloAction, func() codec.DataPtr { return &hello{} }, func(rqData codec.DataPtr) (codec.Action, codec.DataPtr) {
+		pushed <- struct{}{}
+		return codec.Action{}, nil
+	})
+	callCtx, callCancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer callCancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Call(callCtx, greetAction, &hello{Name: "x"}, helloAction, func() codec.DataPtr { return &hello{} })
+		errCh <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	if err := c.Send(helloAction, &hello{Name: "push"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("push not delivered to listener")
+	}
+	if err := <-errCh; !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expect call timeout, got", err)
+	}
+
+	if _, err := c.Call(ctx, greetAction, &hello{}, codec.NewAction(99, "none"), nil); !errors.Is(err, ErrNoResponseStructure) {
+		t.Error("expect no response structure, got", err)
+	}
+}
+
+// metalessBuilder 丢弃元数据的包构建器
+type metalessBuilder struct {
+	codec.PkgBuilder
+}
+
+func (b metalessBuilder) Unpack(bs []byte) (*codec.PKG, error) {
+	p, err := b.PkgBuilder.Unpack(bs)
+	if p != nil {
+		p.Meta = nil
+	}
+	return p, err
+}
+
+func TestClient_CallMessageId(t *testing.T) {
+	a := New(context.Background(), "tcp", "", codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), codec.NewDefaultProtobufPackageBuilder(), codec.NewJsonDataBuilder())
+	b := New(context.Background(), "tcp", "", codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), codec.NewDefaultProtobufPackageBuilder(), codec.NewJsonDataBuilder())
+	if a.callPrefix == "" || a.callPrefix == b.callPrefix {
+		t.Error("expect distinct call id prefixes, got", a.callPrefix, b.callPrefix)
+	}
+
+	c := New(context.Background(), "tcp", "", codec.NewDelimiterCodec([]byte("\n"), []byte("\n")), metalessBuilder{codec.NewDefaultProtobufPackageBuilder()}, codec.NewJsonDataBuilder())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Call(ctx, helloAction, &hello{}, helloAction, func() codec.DataPtr { return &hello{} }); !errors.Is(err, ErrNoMessageId) {
+		t.Error("expect no message id, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expect call fail immediately")
+	}
+}
+
+func TestCallTyped_Protobuf(t *testing.T) {
+	c := New(context.Background(), "tcp", echoServer(t), codec.NewLengthCodec(0xAB, 1024), codec.NewDefaultProtobufPackageBuilder(), codec.NewProtobufDataBuilder(),
+		Logger(func(level zapcore.Level, msg string) {}), PackageLogger(nil), ActionLogger(nil))
+	greetAction := codec.NewAction(3, "greet")
+	ListenTyped(c, greetAction, helloAction, func(ctx context.Context, rq *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String("hi " + rq.GetValue()), nil
+	})
+	c.Start()
+	t.Cleanup(c.Stop)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := CallTyped[wrapperspb.StringValue, wrapperspb.StringValue](ctx, c, greetAction, wrapperspb.String("world"), helloAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetValue() != "hi world" {
+		t.Error("expect hi world, got", resp.GetValue())
+	}
+}
+
+func TestClient_PackTraceParent(t *testing.T) {
+	c := newJsonClient(t, Tracing(NewW3CTracer(nil)))
+	b, err := c.Pack(helloAction, &hello{Name: "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e struct {
+		Meta codec.Meta `json:"meta"`
+	}
+	if err = json.Unmarshal(bytes.TrimSuffix(b, []byte("\n")), &e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseTraceParent(e.Meta.Get(codec.MetaTraceParent)); err != nil {
+		t.Error("expect traceparent in packed meta, got", e.Meta, err)
+	}
+}
+
+func TestWsMessageType(t *testing.T) {
+	for name, expect := range map[codec.Name]client.WsMessageType{
+		codec.Json:      client.TextMessage,
+		codec.ProtoJson: client.TextMessage,
+		codec.ProtoText: client.TextMessage,
+		codec.Proto:     client.BinaryMessage,
+		codec.Msgpack:   client.BinaryMessage,
+		codec.Cbor:      client.BinaryMessage,
+	} {
+		if mt := wsMessageType(name); mt != expect {
+			t.Error(name, "expect", expect, "got", mt)
+		}
+	}
+}
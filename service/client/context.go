@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"github.com/obnahsgnaw/socketutil/codec"
+)
+
+type ctxKey int
+
+const (
+	actionKey ctxKey = iota
+	connIndexKey
+	requestIdKey
+	connCtxKey
+	metaKey
+)
+
+// ContextHandler 带 context 的 action 处理器, ctx 在连接断开或客户端停止时取消, 携带 action、连接序号和请求 id;
+// respAction.Id 为 0 不回复, 返回错误时由 ErrorResponse 配置的 ErrorMapper 决定回复
+type ContextHandler func(ctx context.Context, rqData codec.DataPtr) (respAction codec.Action, respData codec.DataPtr, err error)
+
+// ErrorMapper 将处理错误映射为回复, respAction.Id 为 0 不回复
+type ErrorMapper func(ctx context.Context, action codec.Action, err error) (respAction codec.Action, respData codec.DataPtr)
+
+// ErrorAction 以固定的错误 action 回复, build 构建错误数据
+func ErrorAction(errAction codec.Action, build func(ctx context.Context, action codec.Action, err error) codec.DataPtr) ErrorMapper {
+	return func(ctx context.Context, action codec.Action, err error) (codec.Action, codec.DataPtr) {
+		return errAction, build(ctx, action, err)
+	}
+}
+
+func withMessage(ctx context.Context, action codec.Action, connIndex int, requestId string) context.Context {
+	ctx = context.WithValue(ctx, connCtxKey, ctx)
+	ctx = context.WithValue(ctx, actionKey, action)
+	ctx = context.WithValue(ctx, connIndexKey, connIndex)
+	return context.WithValue(ctx, requestIdKey, requestId)
+}
+
+// ActionFrom 返回当前处理的 action
+func ActionFrom(ctx context.Context) (codec.Action, bool) {
+	a, ok := ctx.Value(actionKey).(codec.Action)
+	return a, ok
+}
+
+// ConnIndexFrom 返回消息所属的连接序号
+func ConnIndexFrom(ctx context.Context) int {
+	i, _ := ctx.Value(connIndexKey).(int)
+	return i
+}
+
+// RequestIdFrom 返回消息的请求 id
+func RequestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// connContextFrom 返回消息所属连接的 context, 不受处理器超时影响
+func connContextFrom(ctx context.Context) context.Context {
+	if c, ok := ctx.Value(connCtxKey).(context.Context); ok {
+		return c
+	}
+	return ctx
+}
+
+func withMeta(ctx context.Context, meta codec.Meta) context.Context {
+	if len(meta) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metaKey, meta)
+}
+
+// MetaFrom 返回消息的元数据
+func MetaFrom(ctx context.Context) codec.Meta {
+	m, _ := ctx.Value(metaKey).(codec.Meta)
+	return m
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"github.com/obnahsgnaw/socketutil/metrics"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchMode 处理器的调度方式
+type DispatchMode int
+
+const (
+	Sequential DispatchMode = 1 // 在接收协程中依次处理
+	Pool       DispatchMode = 2 // 有界协程池并发处理, 不保证顺序
+	Keyed      DispatchMode = 3 // 相同 key 的消息按序处理, 不同 key 并发处理, 默认 key 为 action id
+)
+
+var dispatchModeNames = map[DispatchMode]string{
+	Sequential: "sequential",
+	Pool:       "pool",
+	Keyed:      "keyed",
+}
+
+func (m DispatchMode) String() string {
+	return dispatchModeNames[m]
+}
+
+// DispatchKey Keyed 模式下消息的排序 key
+type DispatchKey func(inv *Invocation) string
+
+func byActionId(inv *Invocation) string {
+	return strconv.Itoa(int(inv.Action.Id))
+}
+
+type dispatcher struct {
+	mode      DispatchMode
+	workers   int
+	queueSize int
+	key       DispatchKey
+	queues    []chan job
+	depth     atomic.Int64
+	hosts     sync.Map // host -> *atomic.Int64
+	gauge     metrics.Gauge
+	running   atomic.Int32
+	// stopped 与向队列发送互斥, 保证不向已关闭的队列发送
+	mu        sync.RWMutex
+	stopped   bool
+	quit      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+// job 队列中的任务, host 为收到消息的连接节点, 作为队列长度指标的标签
+type job struct {
+	host string
+	task func()
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		mode:      Sequential,
+		workers:   1,
+		queueSize: 10,
+		key:       byActionId,
+		gauge:     metrics.Nop.Gauge("", ""),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (d *dispatcher) start() {
+	d.startOnce.Do(func() {
+		if d.mode == Sequential {
+			return
+		}
+		queues := 1
+		if d.mode == Keyed {
+			queues = d.workers
+		}
+		d.queues = make([]chan job, queues)
+		for i := range d.queues {
+			d.queues[i] = make(chan job, d.queueSize)
+		}
+		for i := 0; i < d.workers; i++ {
+			q := d.queues[i%queues]
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				for j := range q {
+					d.track(j.host, -1)
+					d.run(j.task)
+				}
+			}()
+		}
+	})
+}
+
+// run 执行任务并计数, 任务中调用 stop 时不等待
+func (d *dispatcher) run(task func()) {
+	d.running.Add(1)
+	defer d.running.Add(-1)
+	task()
+}
+
+// track 更新总队列长度和节点的队列长度指标
+func (d *dispatcher) track(host string, delta int64) {
+	d.depth.Add(delta)
+	v, _ := d.hosts.LoadOrStore(host, new(atomic.Int64))
+	d.gauge.Set(float64(v.(*atomic.Int64).Add(delta)), host)
+}
+
+// submit 提交处理任务, host 为收到消息的连接节点, 队列满时阻塞, 停止后丢弃
+func (d *dispatcher) submit(host string, inv *Invocation, task func()) {
+	if d.mode == Sequential {
+		d.run(task)
+		return
+	}
+	d.start()
+	q := d.queues[0]
+	if d.mode == Keyed {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(d.key(inv)))
+		q = d.queues[h.Sum32()%uint32(len(d.queues))]
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		return
+	}
+	d.track(host, 1)
+	select {
+	case q <- job{host: host, task: task}:
+	case <-d.quit:
+		d.track(host, -1)
+	}
+}
+
+// close 不再接收新任务, 队列中的任务处理完后 done 关闭
+func (d *dispatcher) close() {
+	d.stopOnce.Do(func() {
+		d.start()
+		close(d.quit)
+		d.mu.Lock()
+		d.stopped = true
+		for _, q := range d.queues {
+			close(q)
+		}
+		d.mu.Unlock()
+		go func() {
+			d.wg.Wait()
+			close(d.done)
+		}()
+	})
+}
+
+// busy 是否有任务正在执行, 任务中调用 Stop 时不能等待自身
+func (d *dispatcher) busy() bool {
+	return d.running.Load() > 0
+}
+
+// QueueDepth 等待处理的消息数
+func (c *Client) QueueDepth() int {
+	return int(c.dispatcher.depth.Load())
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"github.com/obnahsgnaw/socketutil/client"
+)
+
+// 拦截器出错的阶段
+const (
+	OpEncode    = "encode"
+	OpDecode    = "decode"
+	OpIntercept = "intercept"
+)
+
+// InterceptorError 包拦截器错误, 不可重试
+type InterceptorError struct {
+	Direction client.MsgType
+	Op        string
+	Err       error
+}
+
+func (e *InterceptorError) Error() string {
+	return "interceptor error: " + e.Direction.String() + " " + e.Op + " failed, err=" + e.Err.Error()
+}
+
+func (e *InterceptorError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InterceptorError) Temporary() bool {
+	return false
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"sort"
+)
+
+// DefaultHandler 未注册 action 的兜底处理器, 接收未解码的网关包
+type DefaultHandler func(ctx context.Context, pkg *codec.PKG) (respAction codec.Action, respData codec.DataPtr, err error)
+
+// ActionRange action id 区间 [From, To]
+type ActionRange struct {
+	Name string
+	From codec.ActionId
+	To   codec.ActionId
+}
+
+func (r ActionRange) contains(id codec.ActionId) bool {
+	return id >= r.From && id <= r.To
+}
+
+type rangeHandler struct {
+	ActionRange
+	structure DataStructure
+	handler   ContextHandler
+}
+
+// noData 兜底处理器不解码数据
+func noData() codec.DataPtr {
+	return nil
+}
+
+// Unlisten 取消监听 action
+func (c *Client) Unlisten(action codec.Action) {
+	c.delHandler(action.Id)
+}
+
+// ListenRange 监听 id 在 [from, to] 内且没有单独监听的 action, 处理时 action 的名称为注册表中的名称或 name; 区间重叠时最窄的优先
+func (c *Client) ListenRange(name string, from, to codec.ActionId, structure DataStructure, handler ContextHandler) {
+	if from > to {
+		from, to = to, from
+	}
+	c.hLock.Lock()
+	defer c.hLock.Unlock()
+	r := rangeHandler{ActionRange: ActionRange{Name: name, From: from, To: to}, structure: structure, handler: handler}
+	for i, r1 := range c.ranges {
+		if r1.From == from && r1.To == to {
+			c.ranges[i] = r
+			return
+		}
+	}
+	c.ranges = append(c.ranges, r)
+	sort.SliceStable(c.ranges, func(i, j int) bool {
+		return c.ranges[i].To-c.ranges[i].From < c.ranges[j].To-c.ranges[j].From
+	})
+}
+
+// UnlistenRange 取消监听区间
+func (c *Client) UnlistenRange(from, to codec.ActionId) {
+	c.hLock.Lock()
+	defer c.hLock.Unlock()
+	for i, r := range c.ranges {
+		if r.From == from && r.To == to {
+			c.ranges = append(c.ranges[:i], c.ranges[i+1:]...)
+			return
+		}
+	}
+}
+
+// ListenDefault 设置兜底处理器, nil 取消
+func (c *Client) ListenDefault(handler DefaultHandler) {
+	c.hLock.Lock()
+	defer c.hLock.Unlock()
+	c.defaultHandler = handler
+}
+
+// Handlers 已单独监听的 action, 按 id 排序
+func (c *Client) Handlers() []codec.Action {
+	var actions []codec.Action
+	c.handlers.Range(func(key, value any) bool {
+		actions = append(actions, value.(listenHandler).action)
+		return true
+	})
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Id < actions[j].Id
+	})
+	return actions
+}
+
+// HandlerRanges 已监听的区间
+func (c *Client) HandlerRanges() []ActionRange {
+	c.hLock.RLock()
+	defer c.hLock.RUnlock()
+	ranges := make([]ActionRange, len(c.ranges))
+	for i, r := range c.ranges {
+		ranges[i] = r.ActionRange
+	}
+	return ranges
+}
+
+// lookup 依次查找单独监听, 区间监听, 兜底处理器
+func (c *Client) lookup(pkg *codec.PKG) (DataStructure, codec.Action, ContextHandler, bool) {
+	if ds, action, handler, ok := c.getHandler(pkg.Action); ok {
+		return ds, action, handler, true
+	}
+	c.hLock.RLock()
+	defer c.hLock.RUnlock()
+	for _, r := range c.ranges {
+		if r.contains(pkg.Action) {
+			action := c.actionOf(pkg.Action)
+			if action.Name == "" {
+				action.Name = r.Name
+			}
+			return r.structure, action, r.handler, true
+		}
+	}
+	if h := c.defaultHandler; h != nil {
+		handler := func(ctx context.Context, _ codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+			return h(ctx, pkg)
+		}
+		action := c.actionOf(pkg.Action)
+		if action.Name == "" {
+			action.Name = "default"
+		}
+		return noData, action, handler, true
+	}
+	return nil, codec.Action{}, nil, false
+}
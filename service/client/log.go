@@ -0,0 +1,59 @@
+package client
+
+import (
+	"github.com/obnahsgnaw/socketutil/client"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"log"
+)
+
+// 日志字段名
+const (
+	FieldActionId   = "action_id"
+	FieldActionName = "action"
+	FieldRequestId  = "request_id"
+	FieldStack      = "stack"
+)
+
+// logger 复用底层客户端的日志, 追加 action 日志回调
+type logger struct {
+	*client.Log
+	actWatcher func(action codec.Action, msg string)
+	// 回调由选项设置, 不是默认的标准库日志
+	customActWatcher bool
+}
+
+func newLogger(l *client.Log) *logger {
+	return &logger{
+		Log: l,
+		actWatcher: func(action codec.Action, msg string) {
+			log.Println("action[", action.Name, "]", msg)
+		},
+	}
+}
+
+// useZap 底层日志已设置 zap, 关闭仍为默认的 action 日志回调
+func (l *logger) useZap() {
+	if !l.customActWatcher {
+		l.actWatcher = nil
+	}
+}
+
+// action action 处理日志, 回调只接收消息和 action
+func (l *logger) action(level zapcore.Level, action codec.Action, msg string, fields ...zap.Field) {
+	if z := l.Zap(); z != nil {
+		if ce := z.Check(level, msg); ce != nil {
+			ce.Write(append(fields, zap.Uint32(FieldActionId, uint32(action.Id)), zap.String(FieldActionName, action.Name))...)
+		}
+	}
+	if l.actWatcher != nil {
+		l.actWatcher(action, client.FormatFields(msg, fields))
+	}
+}
+
+// fields 当前连接的日志字段
+func (c *Client) fields() []zap.Field {
+	_, index := c.c.ConnContext()
+	return []zap.Field{zap.String(client.FieldHost, c.c.Host()), zap.Int(client.FieldIndex, index)}
+}
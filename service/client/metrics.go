@@ -0,0 +1,63 @@
+package client
+
+import (
+	"github.com/obnahsgnaw/socketutil/client"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"github.com/obnahsgnaw/socketutil/metrics"
+	"time"
+)
+
+// 服务客户端指标名称
+const (
+	MetricCodecErrors       = "socket_service_codec_errors_total"
+	MetricInterceptorErrors = "socket_service_interceptor_errors_total"
+	MetricHandlerDuration   = "socket_service_handler_duration_seconds"
+	MetricHandlerErrors     = "socket_service_handler_errors_total"
+	MetricDispatchDepth     = "socket_service_dispatch_queue_depth"
+)
+
+// 编解码错误的阶段
+const (
+	stageUnmarshal = "unmarshal" // codec 拆包
+	stageUnpack    = "unpack"    // 网关包解包
+	stageDecode    = "decode"    // data 解码
+	stageEncode    = "encode"    // data 编码
+	stagePack      = "pack"      // 网关包封包
+	stageMarshal   = "marshal"   // codec 封包
+)
+
+type serviceMetrics struct {
+	codecErrors       metrics.Counter
+	interceptorErrors metrics.Counter
+	handlerDuration   metrics.Histogram
+	handlerErrors     metrics.Counter
+	dispatchDepth     metrics.Gauge
+}
+
+func newServiceMetrics(m metrics.Metrics) *serviceMetrics {
+	if m == nil {
+		m = metrics.Nop
+	}
+	return &serviceMetrics{
+		codecErrors:       m.Counter(MetricCodecErrors, "Codec errors by stage.", "stage"),
+		interceptorErrors: m.Counter(MetricInterceptorErrors, "Package interceptor errors by direction.", "direction"),
+		handlerDuration:   m.Histogram(MetricHandlerDuration, "Action handler latency in seconds.", metrics.DefBuckets, "action"),
+		handlerErrors:     m.Counter(MetricHandlerErrors, "Action handler errors.", "action"),
+		dispatchDepth:     m.Gauge(MetricDispatchDepth, "Packages waiting for a dispatch worker.", "host"),
+	}
+}
+
+func (m *serviceMetrics) codecError(stage string) {
+	m.codecErrors.Add(1, stage)
+}
+
+func (m *serviceMetrics) interceptorError(mtp client.MsgType) {
+	m.interceptorErrors.Add(1, mtp.String())
+}
+
+func (m *serviceMetrics) handled(action codec.Action, d time.Duration, err error) {
+	m.handlerDuration.Observe(d.Seconds(), action.Name)
+	if err != nil {
+		m.handlerErrors.Add(1, action.Name)
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/obnahsgnaw/socketutil/client"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"runtime/debug"
+)
+
+// Invocation 一次入站处理或出站发送
+type Invocation struct {
+	// Ctx 入站为消息的 context, 出站为当前连接的 context
+	Ctx context.Context
+	// Direction client.Receive 入站处理, client.Send 出站发送
+	Direction client.MsgType
+	Action    codec.Action
+	// Pkg 入站为拆出的网关包; 出站在 next 返回后为封好的网关包
+	Pkg *codec.PKG
+	// Data 入站为解码后的请求数据, 出站为待发送的数据
+	Data codec.DataPtr
+	// Meta 入站为网关包的元数据, 出站为将随网关包发送的元数据, 可在 next 前修改
+	Meta codec.Meta
+	// RespAction RespData 入站处理的回复, RespAction.Id 为 0 不回复
+	RespAction codec.Action
+	RespData   codec.DataPtr
+}
+
+// Invoker 处理一次调用
+type Invoker func(inv *Invocation) error
+
+// Middleware 中间件, 同时作用于入站处理和出站发送, 通过 Invocation.Direction 区分
+type Middleware func(next Invoker) Invoker
+
+// Use 追加中间件, 先追加的在外层
+func (c *Client) Use(middlewares ...Middleware) {
+	c.mwLock.Lock()
+	defer c.mwLock.Unlock()
+	for _, m := range middlewares {
+		if m != nil {
+			c.middlewares = append(c.middlewares, m)
+		}
+	}
+}
+
+func (c *Client) invoke(inv *Invocation, final Invoker) error {
+	c.mwLock.RLock()
+	middlewares := c.middlewares
+	c.mwLock.RUnlock()
+	h := final
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h(inv)
+}
+
+// Recover 将内层的 panic 转为错误返回
+func Recover() Middleware {
+	return func(next Invoker) Invoker {
+		return func(inv *Invocation) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("action[%s] panic: %v, stack=%s", inv.Action.Name, r, debug.Stack())
+				}
+			}()
+			return next(inv)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrNegotiationTimeout = errors.New("negotiation error: timeout")
+
+// protocol 一个连接使用的编解码组合
+type protocol struct {
+	cdc         codec.Codec
+	pgb         codec.PkgBuilder
+	dbd         codec.DataBuilder
+	interceptor PkgInterceptor
+	meta        *metaProbe
+}
+
+// metaProbe 包构建器是否携带元数据, 只探测一次
+type metaProbe struct {
+	once sync.Once
+	ok   bool
+}
+
+// carriesMeta 以探测包封包再解包, 检查 message-id 是否保留
+func (p *protocol) carriesMeta() bool {
+	p.meta.once.Do(func() {
+		b, err := p.pgb.Pack(&codec.PKG{Meta: codec.Meta{codec.MetaMessageId: "probe"}})
+		if err != nil {
+			return
+		}
+		pkg, err := p.pgb.Unpack(b)
+		p.meta.ok = err == nil && pkg != nil && pkg.GetMeta(codec.MetaMessageId) == "probe"
+	})
+	return p.meta.ok
+}
+
+type codecEntry struct {
+	name codec.Name
+	pgb  codec.PkgBuilder
+	dbd  codec.DataBuilder
+}
+
+type framingEntry struct {
+	name string
+	cdc  codec.Codec
+}
+
+type interceptorEntry struct {
+	name        string
+	interceptor PkgInterceptor
+}
+
+// Negotiator 协商支持的版本、数据格式、分帧和拦截器, 添加顺序即优先级
+type Negotiator struct {
+	version      int
+	minVersion   int
+	timeout      time.Duration
+	codecs       []codecEntry
+	framings     []framingEntry
+	interceptors []interceptorEntry
+}
+
+// NewNegotiator 协议版本为 version, 默认超时 5 秒
+func NewNegotiator(version int) *Negotiator {
+	return &Negotiator{version: version, minVersion: version, timeout: 5 * time.Second}
+}
+
+// MinVersion 可接受的最低版本
+func (n *Negotiator) MinVersion(v int) *Negotiator {
+	n.minVersion = v
+	return n
+}
+
+// Timeout 等待对端回复的超时, 超时后使用默认协议
+func (n *Negotiator) Timeout(d time.Duration) *Negotiator {
+	n.timeout = d
+	return n
+}
+
+// Codec 支持的数据格式, 名称为 dbd.Name()
+func (n *Negotiator) Codec(pgb codec.PkgBuilder, dbd codec.DataBuilder) *Negotiator {
+	n.codecs = append(n.codecs, codecEntry{name: dbd.Name(), pgb: pgb, dbd: dbd})
+	return n
+}
+
+// Framing 支持的分帧, 如 codec.FramingLength
+func (n *Negotiator) Framing(name string, cdc codec.Codec) *Negotiator {
+	n.framings = append(n.framings, framingEntry{name: name, cdc: cdc})
+	return n
+}
+
+// Interceptor 支持的拦截器, 如压缩、加密
+func (n *Negotiator) Interceptor(name string, i PkgInterceptor) *Negotiator {
+	n.interceptors = append(n.interceptors, interceptorEntry{name: name, interceptor: i})
+	return n
+}
+
+// Offer 按优先级列出支持的项
+func (n *Negotiator) Offer() codec.Offer {
+	o := codec.Offer{Version: n.version}
+	for _, e := range n.codecs {
+		o.Codecs = append(o.Codecs, e.name)
+	}
+	for _, e := range n.framings {
+		o.Framings = append(o.Framings, e.name)
+	}
+	for _, e := range n.interceptors {
+		o.Interceptors = append(o.Interceptors, e.name)
+	}
+	return o
+}
+
+// Answer 作为对端回复 offer: 版本取两者较小值, 数据格式和分帧选 offer 中第一个支持的, 拦截器选所有支持的,
+// offer 中某项为空时该项保持默认
+func (n *Negotiator) Answer(offer codec.Offer) codec.Answer {
+	a := codec.Answer{Version: offer.Version}
+	if n.version < a.Version {
+		a.Version = n.version
+	}
+	if a.Version < n.minVersion {
+		a.Error = fmt.Sprintf("version %d not supported, min %d", offer.Version, n.minVersion)
+		return a
+	}
+	if len(offer.Codecs) > 0 {
+		if a.Codec = n.pickCodec(offer.Codecs); a.Codec == "" {
+			a.Error = fmt.Sprintf("codecs %v not supported", offer.Codecs)
+			return a
+		}
+	}
+	if len(offer.Framings) > 0 {
+		if a.Framing = n.pickFraming(offer.Framings); a.Framing == "" {
+			a.Error = fmt.Sprintf("framings %v not supported", offer.Framings)
+			return a
+		}
+	}
+	for _, name := range offer.Interceptors {
+		if _, ok := n.interceptor(name); ok {
+			a.Interceptors = append(a.Interceptors, name)
+		}
+	}
+	return a
+}
+
+func (n *Negotiator) pickCodec(names []codec.Name) codec.Name {
+	for _, name := range names {
+		for _, e := range n.codecs {
+			if e.name == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (n *Negotiator) pickFraming(names []string) string {
+	for _, name := range names {
+		for _, e := range n.framings {
+			if e.name == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (n *Negotiator) interceptor(name string) (PkgInterceptor, bool) {
+	for _, e := range n.interceptors {
+		if e.name == name {
+			return e.interceptor, true
+		}
+	}
+	return nil, false
+}
+
+// protocol 按对端的回复在默认协议上替换选中的项
+func (n *Negotiator) protocol(defaults protocol, a codec.Answer) (protocol, error) {
+	if err := a.Err(); err != nil {
+		return defaults, err
+	}
+	if a.Version < n.minVersion || a.Version > n.version {
+		return defaults, fmt.Errorf("%w: version %d", codec.ErrNegotiationFailed, a.Version)
+	}
+	p := defaults
+	if a.Codec != "" {
+		found := false
+		for _, e := range n.codecs {
+			if e.name == a.Codec {
+				p.pgb, p.dbd, found = e.pgb, e.dbd, true
+				break
+			}
+		}
+		if !found {
+			return defaults, fmt.Errorf("%w: codec %s", codec.ErrNegotiationFailed, a.Codec)
+		}
+	}
+	if vb, ok := p.pgb.(*codec.VersionedPackageBuilder); ok {
+		// 版本化的包构建器按协商的版本封包
+		v := codec.PkgVersion(a.Version)
+		if a.Version > 255 || !vb.Supports(v) {
+			return defaults, fmt.Errorf("%w: package version %d", codec.ErrNegotiationFailed, a.Version)
+		}
+		p.pgb = vb.Version(v)
+	}
+	if a.Framing != "" {
+		found := false
+		for _, e := range n.framings {
+			if e.name == a.Framing {
+				p.cdc, found = e.cdc, true
+				break
+			}
+		}
+		if !found {
+			return defaults, fmt.Errorf("%w: framing %s", codec.ErrNegotiationFailed, a.Framing)
+		}
+	}
+	if len(a.Interceptors) > 0 {
+		var chain chainInterceptor
+		for _, name := range a.Interceptors {
+			i, ok := n.interceptor(name)
+			if !ok {
+				return defaults, fmt.Errorf("%w: interceptor %s", codec.ErrNegotiationFailed, name)
+			}
+			chain = append(chain, i)
+		}
+		if len(chain) == 1 {
+			p.interceptor = chain[0]
+		} else {
+			p.interceptor = chain
+		}
+	}
+	return p, nil
+}
+
+// chainInterceptor 按顺序编码, 逆序解码
+type chainInterceptor []PkgInterceptor
+
+func (c chainInterceptor) Encode(b []byte) ([]byte, error) {
+	var err error
+	for _, i := range c {
+		if b, err = i.Encode(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (c chainInterceptor) Decode(b []byte) ([]byte, error) {
+	var err error
+	for j := len(c) - 1; j >= 0; j-- {
+		if b, err = c[j].Decode(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// ServeNegotiation 作为对端读取一条 offer 并回复, 返回回复和 offer 之后已读取的数据, 用于网关或测试
+func ServeNegotiation(conn io.ReadWriter, n *Negotiator) (codec.Answer, []byte, error) {
+	var buf []byte
+	b := make([]byte, 1024)
+	for {
+		var offer codec.Offer
+		rest, err := codec.UnmarshalNegotiation(buf, &offer)
+		if err == nil {
+			a := n.Answer(offer)
+			out, err := codec.MarshalNegotiation(a)
+			if err != nil {
+				return a, rest, err
+			}
+			if _, err = conn.Write(out); err != nil {
+				return a, rest, err
+			}
+			return a, rest, a.Err()
+		}
+		if !errors.Is(err, codec.ErrNeedMoreData) {
+			return codec.Answer{}, buf, err
+		}
+		l, err := conn.Read(b)
+		if l > 0 {
+			buf = append(buf, b[:l]...)
+		}
+		if err != nil {
+			return codec.Answer{}, buf, err
+		}
+	}
+}
+
+// negotiation 一个连接的协商状态, 完成前发送等待
+type negotiation struct {
+	once   sync.Once
+	done   chan struct{}
+	err    error
+	answer codec.Answer
+}
+
+// finish 只有第一次调用生效
+func (n *negotiation) finish(a codec.Answer, err error) (ok bool) {
+	n.once.Do(func() {
+		n.answer, n.err = a, err
+		close(n.done)
+		ok = true
+	})
+	return
+}
+
+func (n *negotiation) finished() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// protocol 当前连接使用的协议, 未设置时为默认协议
+func (c *Client) protocol() *protocol {
+	if p := c.current.Load(); p != nil {
+		return p
+	}
+	d := c.defaults
+	d.meta = &metaProbe{}
+	return &d
+}
+
+// useProtocol 切换协议, nil 为默认协议
+func (c *Client) useProtocol(p *protocol) {
+	if p == nil {
+		d := c.defaults
+		p = &d
+	}
+	p.meta = &metaProbe{}
+	c.current.Store(p)
+}
+
+// negotiate 连接建立后发送 offer, 等待回复或超时, 失败时使用默认协议
+func (c *Client) negotiate(index int) {
+	c.useProtocol(nil)
+	c.c.SetWsMessageType(wsMessageType(c.defaults.dbd.Name()))
+	n := &negotiation{done: make(chan struct{})}
+	c.negotiation.Store(n)
+	b, err := codec.MarshalNegotiation(c.negotiator.Offer())
+	if err == nil {
+		err = c.c.Send(b)
+	}
+	if err != nil {
+		c.finishNegotiation(n, codec.Answer{}, err)
+		return
+	}
+	t := time.NewTimer(c.negotiator.timeout)
+	defer t.Stop()
+	select {
+	case <-n.done:
+	case <-t.C:
+		c.finishNegotiation(n, codec.Answer{}, ErrNegotiationTimeout)
+	}
+}
+
+func (c *Client) finishNegotiation(n *negotiation, a codec.Answer, err error) {
+	if !n.finish(a, err) {
+		return
+	}
+	if err != nil {
+		c.logger.Print(zapcore.WarnLevel, "negotiation failed, use default protocol", append(c.fields(), zap.Error(err))...)
+		return
+	}
+	c.logger.Print(zapcore.InfoLevel, "negotiation done", append(c.fields(), zap.Int("version", a.Version), zap.String("codec", string(c.Protocol())))...)
+}
+
+// negotiateDispatch 协商未完成时解析回复, 返回 false 表示数据已处理或需等待更多数据
+func (c *Client) negotiateDispatch(pkg []byte) ([]byte, bool) {
+	n := c.negotiation.Load()
+	if n == nil || n.finished() {
+		return pkg, true
+	}
+	var a codec.Answer
+	rest, err := codec.UnmarshalNegotiation(pkg, &a)
+	if errors.Is(err, codec.ErrNeedMoreData) {
+		c.c.Tmp = append([]byte(nil), pkg...)
+		return nil, false
+	}
+	if err != nil {
+		c.finishNegotiation(n, a, err)
+		return pkg, true
+	}
+	p, err := c.negotiator.protocol(c.defaults, a)
+	if err == nil {
+		c.useProtocol(&p)
+		c.c.SetWsMessageType(wsMessageType(p.dbd.Name()))
+	}
+	c.finishNegotiation(n, a, err)
+	return rest, len(rest) > 0
+}
+
+// waitNegotiation 发送前等待协商完成
+func (c *Client) waitNegotiation(ctx context.Context) error {
+	n := c.negotiation.Load()
+	if n == nil {
+		return nil
+	}
+	select {
+	case <-n.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PkgVersion 当前连接封包使用的版本, 包构建器不是 *codec.VersionedPackageBuilder 时返回 false
+func (c *Client) PkgVersion() (codec.PkgVersion, bool) {
+	if vb, ok := c.protocol().pgb.(*codec.VersionedPackageBuilder); ok {
+		return vb.PackVersion(), true
+	}
+	return 0, false
+}
+
+// Protocol 当前使用的数据格式
+func (c *Client) Protocol() codec.Name {
+	return c.protocol().dbd.Name()
+}
+
+// Negotiated 最近一次协商的结果, 未协商或失败时返回错误
+func (c *Client) Negotiated() (codec.Answer, error) {
+	n := c.negotiation.Load()
+	if n == nil || !n.finished() {
+		return codec.Answer{}, codec.ErrNotNegotiation
+	}
+	return n.answer, n.err
+}
@@ -3,7 +3,11 @@ package client
 import (
 	client2 "github.com/obnahsgnaw/socketutil/client"
 	"github.com/obnahsgnaw/socketutil/codec"
+	"github.com/obnahsgnaw/socketutil/metrics"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"net"
+	"net/http"
 	"time"
 )
 
@@ -27,6 +31,18 @@ func Keepalive(interval time.Duration) Option {
 	}
 }
 
+func HeartbeatTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.c.With(client2.HeartbeatTimeout(timeout))
+	}
+}
+
+func ReadBuffer(size int) Option {
+	return func(client *Client) {
+		client.c.With(client2.ReadBuffer(size))
+	}
+}
+
 func Connect(handler func(index int)) Option {
 	return func(client *Client) {
 		client.c.With(client2.Connect(handler))
@@ -41,29 +57,199 @@ func Disconnect(handler func(index int)) Option {
 
 func Logger(watcher func(level zapcore.Level, msg string)) Option {
 	return func(client *Client) {
-		if watcher == nil {
-			watcher = func(level zapcore.Level, msg string) {}
-		}
-		client.logWatcher = watcher
 		client.c.With(client2.Logger(watcher))
 	}
 }
 
+// ZapLogger 以 zap 输出带 host、index、action 等字段的结构化日志, 并关闭默认的标准库日志回调,
+// 通过 Logger、ActionLogger、PackageLogger 设置的回调不论选项先后都仍会收到日志
+func ZapLogger(l *zap.Logger) Option {
+	return func(client *Client) {
+		client.c.With(client2.ZapLogger(l))
+		client.logger.useZap()
+	}
+}
+
+// PackageSampling zap 包日志采样, 每 tick 内相同消息只记录前 first 条, 之后每 thereafter 条记录一条
+func PackageSampling(tick time.Duration, first, thereafter int) Option {
+	return func(client *Client) {
+		client.c.With(client2.PackageSampling(tick, first, thereafter))
+	}
+}
+
 func ActionLogger(watcher func(action codec.Action, msg string)) Option {
 	return func(client *Client) {
 		if watcher == nil {
 			watcher = func(action codec.Action, msg string) {}
 		}
-		client.actWatcher = watcher
+		client.logger.actWatcher = watcher
+		client.logger.customActWatcher = true
 	}
 }
 
 func PackageLogger(watcher func(mtp client2.MsgType, msg string, pkg []byte)) Option {
 	return func(client *Client) {
-		if watcher == nil {
-			watcher = func(mtp client2.MsgType, msg string, pkg []byte) {}
-		}
-		client.pkgWatcher = watcher
 		client.c.With(client2.Package(watcher))
 	}
 }
+
+func WsHeader(header http.Header) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsHeader(header))
+	}
+}
+
+func WsSubprotocols(protocols ...string) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsSubprotocols(protocols...))
+	}
+}
+
+func WsOrigin(origin string) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsOrigin(origin))
+	}
+}
+
+func WsCookieJar(jar http.CookieJar) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsCookieJar(jar))
+	}
+}
+
+func WsHandshakeTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsHandshakeTimeout(timeout))
+	}
+}
+
+func WsReadLimit(limit int64) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsReadLimit(limit))
+	}
+}
+
+func WsCompression(enable bool) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsCompression(enable))
+	}
+}
+
+// WsMessage 覆盖根据 data builder 自动选择的 websocket 消息类型
+func WsMessage(mt client2.WsMessageType) Option {
+	return func(client *Client) {
+		client.c.With(client2.WsMessage(mt))
+	}
+}
+
+func Endpoints(hosts ...string) Option {
+	return func(client *Client) {
+		client.c.With(client2.Endpoints(hosts...))
+	}
+}
+
+func Balance(strategy client2.Strategy) Option {
+	return func(client *Client) {
+		client.c.With(client2.Balance(strategy))
+	}
+}
+
+func EndpointPenalty(penalty, maxPenalty time.Duration) Option {
+	return func(client *Client) {
+		client.c.With(client2.EndpointPenalty(penalty, maxPenalty))
+	}
+}
+
+func SRV(service, proto, name string, refresh time.Duration, resolver *net.Resolver) Option {
+	return func(client *Client) {
+		client.c.With(client2.SRV(service, proto, name, refresh, resolver))
+	}
+}
+
+// ErrorResponse 处理器或中间件返回错误时的回复映射, 为空不回复
+func ErrorResponse(mapper ErrorMapper) Option {
+	return func(client *Client) {
+		client.errorMapper = mapper
+	}
+}
+
+// Dispatch 处理器调度方式, workers 为并发数, queueSize 为每个队列的长度, 队列满时阻塞接收
+func Dispatch(mode DispatchMode, workers, queueSize int) Option {
+	return func(client *Client) {
+		if _, ok := dispatchModeNames[mode]; ok {
+			client.dispatcher.mode = mode
+		}
+		if workers > 0 {
+			client.dispatcher.workers = workers
+		}
+		if queueSize > 0 {
+			client.dispatcher.queueSize = queueSize
+		}
+	}
+}
+
+// DispatchKeyBy Keyed 调度模式下的排序 key, 默认按 action id
+func DispatchKeyBy(key DispatchKey) Option {
+	return func(client *Client) {
+		if key != nil {
+			client.dispatcher.key = key
+		}
+	}
+}
+
+// HandlerTimeout 处理器超时, 超时后 context 取消并按错误处理
+func HandlerTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.handlerTimeout = timeout
+	}
+}
+
+func Queue(size int) Option {
+	return func(client *Client) {
+		client.c.With(client2.Queue(size))
+	}
+}
+
+// StreamBuffer 流的发送队列长度, 默认 16
+func StreamBuffer(size int) Option {
+	return func(client *Client) {
+		if size > 0 {
+			client.streamBuffer = size
+		}
+	}
+}
+
+// Registry action 注册表, 用于补全 action 名称, 拒绝发送未注册的 action, 以及为未提供 DataStructure 的监听提供数据结构
+func Registry(registry *codec.ActionRegistry) Option {
+	return func(client *Client) {
+		client.registry = registry
+	}
+}
+
+// Tracing 链路追踪, 发送时将 traceparent 写入元数据, 接收时从元数据继续链路
+func Tracing(tracer Tracer) Option {
+	return func(client *Client) {
+		if tracer != nil {
+			client.tracer = tracer
+		}
+	}
+}
+
+// Metrics 记录连接、编解码、拦截器、处理器和队列指标, 为空不记录
+func Metrics(m metrics.Metrics) Option {
+	return func(client *Client) {
+		client.c.With(client2.Metrics(m))
+		client.metrics = newServiceMetrics(m)
+		client.dispatcher.gauge = client.metrics.dispatchDepth
+	}
+}
+
+// Negotiate 连接建立后与网关协商版本、数据格式、分帧和拦截器, 协商完成或超时前发送等待, 失败时使用默认协议
+func Negotiate(n *Negotiator) Option {
+	return func(client *Client) {
+		if n != nil && client.negotiator == nil {
+			client.negotiator = n
+			client.c.With(client2.Handshake(client.negotiate))
+		}
+	}
+}
@@ -1,14 +1,33 @@
 package client
 
+import (
+	"github.com/obnahsgnaw/socketutil/client"
+	"github.com/obnahsgnaw/socketutil/codec"
+)
+
 type PkgInterceptor interface {
 	Encode([]byte) ([]byte, error)
 	Decode([]byte) ([]byte, error)
 }
 
+// PkgMetaInterceptor 拦截器可选实现, 在网关包封包前和拆包后访问和修改元数据
+type PkgMetaInterceptor interface {
+	InterceptPkg(mtp client.MsgType, pkg *codec.PKG) error
+}
+
 func GatewayPkgInterceptor(i PkgInterceptor) Option {
 	return func(c *Client) {
 		if i != nil {
-			c.pkgInterceptor = i
+			c.defaults.interceptor = i
+		}
+	}
+}
+
+// PinPkgVersion 包构建器为 *codec.VersionedPackageBuilder 时固定封包的版本, 协商成功时使用协商的版本
+func PinPkgVersion(v codec.PkgVersion) Option {
+	return func(c *Client) {
+		if vb, ok := c.defaults.pgb.(*codec.VersionedPackageBuilder); ok {
+			c.defaults.pgb = vb.Version(v)
 		}
 	}
 }
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrStreamClosed = errors.New("client error: stream closed")
+
+// StreamHandler 可多次回复的处理器, 处理器返回时流自动关闭, 调用 Stream.Detach 后由调用方负责关闭
+type StreamHandler func(ctx context.Context, rqData codec.DataPtr, stream *Stream) error
+
+type streamPkg struct {
+	action codec.Action
+	data   codec.DataPtr
+}
+
+// Stream 向网关发送多个回复, 发送队列满时 Send 阻塞, 连接断开或客户端停止时取消
+type Stream struct {
+	c         *Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+	queue     chan streamPkg
+	closed    chan struct{}
+	finished  chan struct{}
+	closeOnce sync.Once
+	errLock   sync.Mutex
+	err       error
+	detached  atomic.Bool
+}
+
+func (c *Client) newStream(ctx context.Context) *Stream {
+	action, _ := ActionFrom(ctx)
+	ctx = withMeta(withMessage(connContextFrom(ctx), action, ConnIndexFrom(ctx), RequestIdFrom(ctx)), MetaFrom(ctx))
+	s := &Stream{
+		c:        c,
+		queue:    make(chan streamPkg, c.streamBuffer),
+		closed:   make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	c.streams.Add(1)
+	go func() {
+		defer c.streams.Done()
+		s.run()
+	}()
+	return s
+}
+
+func (s *Stream) run() {
+	defer close(s.finished)
+	for {
+		select {
+		case p := <-s.queue:
+			s.write(p)
+		case <-s.closed:
+			for {
+				select {
+				case p := <-s.queue:
+					s.write(p)
+				default:
+					return
+				}
+			}
+		case <-s.ctx.Done():
+			s.setErr(s.ctx.Err())
+			return
+		}
+	}
+}
+
+func (s *Stream) write(p streamPkg) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	if err := s.c.SendContext(s.ctx, p.action, p.data); err != nil {
+		s.setErr(err)
+		s.cancel()
+	}
+}
+
+func (s *Stream) setErr(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Context 流的 context, 携带请求的 action, 连接序号和请求 id
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Send 排队发送一个回复, 队列满时阻塞直到有空位, 流关闭或取消
+func (s *Stream) Send(action codec.Action, data codec.DataPtr) error {
+	select {
+	case <-s.closed:
+		return ErrStreamClosed
+	case <-s.ctx.Done():
+		return s.Err()
+	default:
+	}
+	select {
+	case s.queue <- streamPkg{action: action, data: data}:
+		return nil
+	case <-s.closed:
+		return ErrStreamClosed
+	case <-s.ctx.Done():
+		return s.Err()
+	}
+}
+
+// Detach 处理器返回后保持流打开, 需调用 Close 关闭
+func (s *Stream) Detach() {
+	s.detached.Store(true)
+}
+
+// Close 停止接收新回复, 等待队列发送完成, 返回发送过程中的第一个错误
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		<-s.finished
+		s.cancel()
+	})
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if errors.Is(s.err, context.Canceled) {
+		return nil
+	}
+	return s.err
+}
+
+// Done 流结束后关闭
+func (s *Stream) Done() <-chan struct{} {
+	return s.finished
+}
+
+// Err 流的错误
+func (s *Stream) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.ctx.Err()
+}
+
+// ListenStream 监听 action, 处理器通过 stream 发送任意数量的回复
+func (c *Client) ListenStream(action codec.Action, structure DataStructure, handler StreamHandler) {
+	c.ListenContext(action, structure, func(ctx context.Context, rqData codec.DataPtr) (codec.Action, codec.DataPtr, error) {
+		s := c.newStream(ctx)
+		if err := handler(ctx, rqData, s); err != nil {
+			_ = s.Close()
+			return codec.Action{}, nil, err
+		}
+		if !s.detached.Load() {
+			if err := s.Close(); err != nil {
+				return codec.Action{}, nil, err
+			}
+		}
+		return codec.Action{}, nil, nil
+	})
+}
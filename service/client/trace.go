@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/obnahsgnaw/socketutil/codec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTraceParent = errors.New("trace error: invalid traceparent")
+
+// TraceParent W3C traceparent: version-traceid-spanid-flags
+type TraceParent struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+}
+
+// ParseTraceParent 解析 traceparent, 只支持 00 版本
+func ParseTraceParent(s string) (tp TraceParent, err error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tp, ErrInvalidTraceParent
+	}
+	var flags [1]byte
+	if _, err = hex.Decode(tp.TraceId[:], []byte(parts[1])); err != nil {
+		return tp, ErrInvalidTraceParent
+	}
+	if _, err = hex.Decode(tp.SpanId[:], []byte(parts[2])); err != nil {
+		return tp, ErrInvalidTraceParent
+	}
+	if _, err = hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return tp, ErrInvalidTraceParent
+	}
+	tp.Flags = flags[0]
+	if !tp.Valid() {
+		return tp, ErrInvalidTraceParent
+	}
+	return tp, nil
+}
+
+// Valid trace id 和 span id 都不全为 0
+func (tp TraceParent) Valid() bool {
+	return tp.TraceId != [16]byte{} && tp.SpanId != [8]byte{}
+}
+
+func (tp TraceParent) Sampled() bool {
+	return tp.Flags&0x01 == 0x01
+}
+
+func (tp TraceParent) String() string {
+	return "00-" + hex.EncodeToString(tp.TraceId[:]) + "-" + hex.EncodeToString(tp.SpanId[:]) + "-" + hex.EncodeToString([]byte{tp.Flags})
+}
+
+// Span 链路中的一段, 由 Tracer 实现
+type Span interface {
+	AddEvent(name string)
+	RecordError(err error)
+	End()
+}
+
+// Tracer 链路追踪, 可适配 OpenTelemetry: carrier 实现了 Get/Set/Keys, 可直接作为 TextMapCarrier 使用
+type Tracer interface {
+	// Start 开始一个 span, 若 ctx 中没有上级 span 则从 carrier 中提取上游链路, carrier 可为空
+	Start(ctx context.Context, name string, carrier codec.Meta) (context.Context, Span)
+	// Inject 将 ctx 中的链路写入 carrier
+	Inject(ctx context.Context, carrier codec.Meta)
+}
+
+type spanKeyType struct{}
+
+var spanKey spanKeyType
+
+func (c *Client) startSpan(ctx context.Context, name string, carrier codec.Meta) (context.Context, Span) {
+	ctx, span := c.tracer.Start(ctx, name, carrier)
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// SpanFrom 返回 ctx 中的 span, 没有时返回空实现
+func SpanFrom(ctx context.Context) Span {
+	if s, ok := ctx.Value(spanKey).(Span); ok {
+		return s
+	}
+	return noopSpan{}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ codec.Meta) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(context.Context, codec.Meta) {}
+
+type noopSpan struct{}
+
+func (noopSpan) AddEvent(string)   {}
+func (noopSpan) RecordError(error) {}
+func (noopSpan) End()              {}
+
+// SpanEvent span 事件
+type SpanEvent struct {
+	Name string
+	Time time.Time
+}
+
+// SpanData W3CTracer 结束的 span
+type SpanData struct {
+	Name    string
+	Parent  TraceParent // 上级, 无上级时无效
+	Context TraceParent
+	Start   time.Time
+	End     time.Time
+	Events  []SpanEvent
+	Err     error
+}
+
+// W3CTracer 只做 traceparent 传播的简单实现, span 结束时回调 onEnd
+type W3CTracer struct {
+	onEnd func(SpanData)
+}
+
+func NewW3CTracer(onEnd func(SpanData)) *W3CTracer {
+	return &W3CTracer{onEnd: onEnd}
+}
+
+type w3cSpanKeyType struct{}
+
+var w3cSpanKey w3cSpanKeyType
+
+func (t *W3CTracer) Start(ctx context.Context, name string, carrier codec.Meta) (context.Context, Span) {
+	s := &w3cSpan{tracer: t, data: SpanData{Name: name, Start: time.Now()}}
+	if parent, ok := ctx.Value(w3cSpanKey).(*w3cSpan); ok {
+		s.data.Parent = parent.data.Context
+	} else if tp, err := ParseTraceParent(carrier.Get(codec.MetaTraceParent)); err == nil {
+		s.data.Parent = tp
+	}
+	if s.data.Parent.Valid() {
+		s.data.Context.TraceId = s.data.Parent.TraceId
+		s.data.Context.Flags = s.data.Parent.Flags
+	} else {
+		_, _ = rand.Read(s.data.Context.TraceId[:])
+		s.data.Context.Flags = 0x01
+	}
+	_, _ = rand.Read(s.data.Context.SpanId[:])
+
+	return context.WithValue(ctx, w3cSpanKey, s), s
+}
+
+func (t *W3CTracer) Inject(ctx context.Context, carrier codec.Meta) {
+	if s, ok := ctx.Value(w3cSpanKey).(*w3cSpan); ok && carrier != nil {
+		carrier.Set(codec.MetaTraceParent, s.data.Context.String())
+	}
+}
+
+type w3cSpan struct {
+	tracer  *W3CTracer
+	mu      sync.Mutex
+	data    SpanData
+	endOnce sync.Once
+}
+
+func (s *w3cSpan) AddEvent(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Events = append(s.data.Events, SpanEvent{Name: name, Time: time.Now()})
+}
+
+func (s *w3cSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.data.Err = err
+	}
+}
+
+func (s *w3cSpan) End() {
+	s.endOnce.Do(func() {
+		s.mu.Lock()
+		s.data.End = time.Now()
+		data := s.data
+		s.mu.Unlock()
+		if s.tracer.onEnd != nil {
+			s.tracer.onEnd(data)
+		}
+	})
+}